@@ -0,0 +1,191 @@
+package log2fuse
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sources of a request attribute rule
+const (
+	attributeSourceHeader = "header"
+	attributeSourceCookie = "cookie"
+	attributeSourceJWT    = "jwt"
+	attributeSourceQuery  = "query"
+	attributeSourceBody   = "body"
+)
+
+// attributeRule tells where an attribute of a request, like its session or user id, comes from.
+//
+// Rules are written as "<source>:<name>":
+//   - header:X-Session-Id, the value of a request header
+//   - cookie:session, the value of a cookie
+//   - jwt:sid, a claim of the token in the first of Config.JWTHeaders holding a JWT,
+//     the Authorization header when none is configured, nested claims as a.b
+//   - query:session, a query parameter
+//   - body:metadata.session_id, a field of the JSON request body, nested fields as a.b
+//
+// The body is read for the body rules even when it is not logged, up to
+// Config.MaxRequestBodyBytes: a field cut by that limit cannot be resolved.
+// With Config.Debug the rules that cannot be resolved are logged.
+type attributeRule struct {
+	source string
+	name   string
+}
+
+// parseAttributeRules parses the rules, skipping the invalid ones
+func parseAttributeRules(rules []string, logger *log.Logger) []attributeRule {
+	var parsed []attributeRule
+	for _, rule := range rules {
+		source, name, ok := strings.Cut(strings.TrimSpace(rule), ":")
+		source = strings.ToLower(strings.TrimSpace(source))
+		name = strings.TrimSpace(name)
+		switch {
+		case !ok || name == "":
+			logger.Printf("invalid attribute rule %q, expecting <source>:<name>", rule)
+		case source == attributeSourceHeader || source == attributeSourceCookie || source == attributeSourceJWT ||
+			source == attributeSourceQuery || source == attributeSourceBody:
+			parsed = append(parsed, attributeRule{source: source, name: name})
+		default:
+			logger.Printf("unknown source %q in attribute rule %q", source, rule)
+		}
+	}
+	return parsed
+}
+
+// hasAttributeSource tells whether one of the rules reads the source
+func hasAttributeSource(rules []attributeRule, source string) bool {
+	for _, rule := range rules {
+		if rule.source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAttributes resolves attribute rules against a request. The JWT
+// claims and the JSON body are decoded once, on first use.
+type requestAttributes struct {
+	request    *http.Request
+	jwtHeaders []string
+	// body returns the request body, and whether it was cut by the capture limit
+	body func() (string, bool)
+	// logger logs the rules that cannot be resolved, nil to keep quiet
+	logger *log.Logger
+
+	claims       map[string]interface{}
+	claimsParsed bool
+	json         interface{}
+	jsonParsed   bool
+	bodyProblem  string
+}
+
+// resolve returns the value of the first rule that matches, empty if none
+func (a *requestAttributes) resolve(attribute string, rules []attributeRule) string {
+	for _, rule := range rules {
+		value, problem := a.value(rule)
+		if value != "" {
+			return value
+		}
+		if problem != "" && a.logger != nil {
+			a.logger.Printf("%s rule %s:%s cannot be resolved on %s %s: %s", attribute, rule.source, rule.name, a.request.Method, a.request.URL.Path, problem)
+		}
+	}
+	return ""
+}
+
+// value returns the value of a rule. When the value is missing because the
+// source cannot be read, rather than because the request does not carry it,
+// the problem is returned as well.
+func (a *requestAttributes) value(rule attributeRule) (string, string) {
+	switch rule.source {
+	case attributeSourceHeader:
+		return a.request.Header.Get(rule.name), ""
+	case attributeSourceCookie:
+		if cookie, err := a.request.Cookie(rule.name); err == nil {
+			return cookie.Value, ""
+		}
+	case attributeSourceQuery:
+		return a.request.URL.Query().Get(rule.name), ""
+	case attributeSourceJWT:
+		if !a.claimsParsed {
+			a.claimsParsed = true
+			a.claims = a.jwtClaims()
+		}
+		if a.claims == nil {
+			return "", "no JWT in the request headers"
+		}
+		if value, ok := lookupField(a.claims, rule.name); ok {
+			return attributeString(value), ""
+		}
+	case attributeSourceBody:
+		if !a.jsonParsed {
+			a.jsonParsed = true
+			a.parseBody()
+		}
+		if a.bodyProblem != "" {
+			return "", a.bodyProblem
+		}
+		if value, ok := lookupField(a.json, rule.name); ok {
+			return attributeString(value), ""
+		}
+	}
+	return "", ""
+}
+
+// parseBody decodes the JSON request body, noting why it cannot be when it is not empty
+func (a *requestAttributes) parseBody() {
+	text, truncated := a.body()
+	if err := json.Unmarshal([]byte(text), &a.json); err == nil {
+		return
+	}
+	a.json = nil
+	switch {
+	case truncated:
+		a.bodyProblem = "the request body is cut by the capture limit"
+	case strings.TrimSpace(text) != "":
+		a.bodyProblem = "the request body is not JSON"
+	}
+}
+
+// jwtClaims returns the claims of the first JWT header, nil when there is none
+func (a *requestAttributes) jwtClaims() map[string]interface{} {
+	headers := a.jwtHeaders
+	if len(headers) == 0 {
+		headers = []string{"Authorization"}
+	}
+	for _, header := range headers {
+		if claims, ok := jwtClaims(a.request.Header.Get(header)); ok {
+			return claims
+		}
+	}
+	return nil
+}
+
+// lookupField follows a dotted path like metadata.session_id into decoded JSON
+func lookupField(value interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// attributeString formats a string or number value, other values are ignored
+func attributeString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package log2fuse
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoffDelay = time.Second
+	maxBackoffDelay = time.Minute
+)
+
+// backoff is the delay shared by every ingestion request: after a failure
+// no batch is sent before it has elapsed, so a rate limited or failing
+// langfuse is not hit again by each batch on its own schedule.
+type backoff struct {
+	clock LoggerClock
+	mu    sync.Mutex
+	until time.Time
+	delay time.Duration
+}
+
+// fail doubles the delay, or uses retryAfter when the server asked for one,
+// and returns it. The delay never exceeds maxBackoffDelay, so that a server
+// asking for hours does not stop the logger for as long.
+func (b *backoff) fail(retryAfter time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case retryAfter > 0:
+		b.delay = retryAfter
+	case b.delay == 0:
+		b.delay = minBackoffDelay
+	default:
+		b.delay *= 2
+	}
+	if b.delay > maxBackoffDelay {
+		b.delay = maxBackoffDelay
+	}
+	b.until = b.clock.Now().Add(b.delay)
+	return b.delay
+}
+
+// succeed resets the delay
+func (b *backoff) succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.delay = 0
+	b.until = time.Time{}
+}
+
+// active tells whether requests must still wait
+func (b *backoff) active() bool {
+	return b.remaining() > 0
+}
+
+func (b *backoff) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.until.Sub(b.clock.Now())
+}
+
+// wait blocks until the delay has elapsed or ctx is done
+func (b *backoff) wait(ctx context.Context) error {
+	remaining := b.remaining()
+	if remaining <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,216 @@
+package log2fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"unicode/utf8"
+)
+
+// binarySummary describes a binary body or file part instead of logging its bytes
+type binarySummary struct {
+	Name        string `json:"name,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+	Base64      string `json:"base64,omitempty"`
+	// Truncated tells that the part was cut by the capture limit, its size and hash are the ones of the captured prefix
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// multipartField is a text field of a multipart body
+type multipartField struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// ContentHTTPDecoder turns the body decoded by another decoder into loggable text
+// according to its content type: declared charsets are transcoded to UTF-8,
+// multipart bodies are split into their parts and binary bodies are replaced by a summary.
+type ContentHTTPDecoder struct {
+	decoder     HTTPBodyDecoder
+	contentType string
+	logger      *log.Logger
+	// base64MaxBytes is the size up to which binaries are logged in base64, 0 to never log them
+	base64MaxBytes int
+}
+
+func (d *ContentHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	text, err := d.decoder.decode(content)
+	if text == "" {
+		return text, err
+	}
+
+	mediaType, params, parseErr := mime.ParseMediaType(d.contentType)
+	if parseErr == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		if summary, ok := d.summarizeMultipart(text, params["boundary"]); ok {
+			return summary, err
+		}
+	}
+	if charset := params["charset"]; charset != "" && !isBinaryContentType(mediaType) {
+		transcoded, charsetErr := transcodeCharset(text, charset)
+		if charsetErr != nil {
+			d.logger.Printf("Failed to decode the %s charset: %s", charset, charsetErr)
+		} else {
+			text = transcoded
+		}
+	}
+	if isBinaryContentType(mediaType) || !isUTF8Text(text) {
+		summary, encodeErr := encodeJSON(d.summarizeBinary("", "", mediaType, []byte(text)))
+		if encodeErr != nil {
+			return "", encodeErr
+		}
+		return summary, err
+	}
+	return text, err
+}
+
+// summarizeMultipart keeps the text fields and summarizes the files.
+// A part cut by the capture limit is kept as far as it was captured and
+// marked truncated; the parts after it or after a malformed part are left out.
+func (d *ContentHTTPDecoder) summarizeMultipart(text, boundary string) (string, bool) {
+	reader := multipart.NewReader(strings.NewReader(text), boundary)
+	var parts []interface{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, readErr := io.ReadAll(part)
+		truncated := readErr != nil
+		contentType := part.Header.Get("Content-Type")
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		text := utf8.Valid(data) || truncated && isUTF8Text(string(data))
+		if part.FileName() == "" && !isBinaryContentType(mediaType) && text {
+			parts = append(parts, multipartField{Name: part.FormName(), Value: string(data), Truncated: truncated})
+		} else {
+			summary := d.summarizeBinary(part.FormName(), part.FileName(), contentType, data)
+			summary.Truncated = truncated
+			parts = append(parts, summary)
+		}
+		if truncated {
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+
+	summary, err := encodeJSON(map[string]interface{}{"parts": parts})
+	if err != nil {
+		return "", false
+	}
+	return summary, true
+}
+
+func (d *ContentHTTPDecoder) summarizeBinary(name, filename, contentType string, data []byte) *binarySummary {
+	sum := sha256.Sum256(data)
+	summary := &binarySummary{
+		Name:        name,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        len(data),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	if len(data) <= d.base64MaxBytes {
+		summary.Base64 = base64.StdEncoding.EncodeToString(data)
+	}
+	return summary
+}
+
+// isUTF8Text tells whether the text is valid UTF-8, ignoring a last rune cut by the capture limit
+func isUTF8Text(text string) bool {
+	if utf8.ValidString(text) {
+		return true
+	}
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			return !utf8.FullRuneInString(text[i:]) && utf8.ValidString(text[:i])
+		}
+	}
+	return false
+}
+
+// isBinaryContentType tells whether a media type is binary whatever its bytes
+func isBinaryContentType(mediaType string) bool {
+	if strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json") {
+		return false
+	}
+	major, minor, _ := strings.Cut(mediaType, "/")
+	switch major {
+	case "image", "audio", "video", "font":
+		return true
+	case "application":
+		switch minor {
+		case "octet-stream", "pdf", "zip", "gzip", "x-protobuf", "protobuf", "grpc", "wasm", "msword":
+			return true
+		}
+		return strings.HasPrefix(minor, "vnd.openxmlformats") || strings.HasPrefix(minor, "vnd.ms-")
+	}
+	return false
+}
+
+// structuredBody returns the parsed value of a JSON body, or the array of the values of an
+// NDJSON body, so that the loggers embed it instead of an escaped string.
+// The bodies of other content types or that do not parse are returned as text.
+func structuredBody(text, contentType string) interface{} {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || text == "" {
+		return text
+	}
+
+	switch {
+	case isJSONContentType(mediaType):
+		if value, ok := parseJSONValue(text); ok {
+			return value
+		}
+	case isNDJSONContentType(mediaType):
+		var values []interface{}
+		for _, line := range strings.Split(text, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			value, ok := parseJSONValue(line)
+			if !ok {
+				return text
+			}
+			values = append(values, value)
+		}
+		if len(values) > 0 {
+			return values
+		}
+	}
+	return text
+}
+
+// parseJSONValue parses a single JSON value, keeping the numbers as written
+func parseJSONValue(text string) (interface{}, bool) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return nil, false
+	}
+	return value, true
+}
+
+func isJSONContentType(mediaType string) bool {
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isNDJSONContentType(mediaType string) bool {
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines", "application/jsonlines":
+		return true
+	}
+	return false
+}
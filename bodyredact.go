@@ -0,0 +1,317 @@
+package log2fuse
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Kinds of a JSONPath segment
+const (
+	jsonPathField = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathDescendant
+)
+
+// jsonPathSegment is one step of a JSONPath: .name, [0], [*] or ..name
+type jsonPathSegment struct {
+	kind  int
+	name  string
+	index int
+}
+
+// jsonPath is a parsed JSONPath like $.messages[*].content
+type jsonPath []jsonPathSegment
+
+// bodyFieldRedaction redacts a field of the JSON bodies of the requests matching a route prefix.
+//
+// Redactions are written as "[<METHOD URL prefix> ]<JSONPath>":
+//   - $.api_key, the api_key field of every body
+//   - POST /v1/chat/completions $.messages[*].content, the content of every message on a route
+//   - $..password, every password field whatever its depth
+type bodyFieldRedaction struct {
+	route string
+	path  jsonPath
+}
+
+// parseBodyFieldRedactions parses the redactions, skipping the invalid ones
+func parseBodyFieldRedactions(redactions []string, logger *log.Logger) []bodyFieldRedaction {
+	var parsed []bodyFieldRedaction
+	for _, redaction := range redactions {
+		redaction = strings.TrimSpace(redaction)
+		if redaction == "" {
+			continue
+		}
+		route, expression := "", redaction
+		if !strings.HasPrefix(redaction, "$") {
+			i := strings.Index(redaction, " $")
+			if i < 0 {
+				logger.Printf("invalid body field redaction %q, expecting [<method> <url prefix> ]<jsonpath>", redaction)
+				continue
+			}
+			route, expression = strings.TrimSpace(redaction[:i]), redaction[i+1:]
+		}
+		path, err := parseJSONPath(expression)
+		if err != nil {
+			logger.Printf("invalid body field redaction %q: %s", redaction, err)
+			continue
+		}
+		parsed = append(parsed, bodyFieldRedaction{route: route, path: path})
+	}
+	return parsed
+}
+
+// matchBodyFieldRedactions returns the paths to redact in the bodies of a request
+func matchBodyFieldRedactions(r *http.Request, redactions []bodyFieldRedaction) []jsonPath {
+	method := r.Method + " " + r.URL.String()
+	var paths []jsonPath
+	for _, redaction := range redactions {
+		if strings.HasPrefix(method, redaction.route) {
+			paths = append(paths, redaction.path)
+		}
+	}
+	return paths
+}
+
+// parseJSONPath parses the subset of JSONPath made of fields, indexes,
+// wildcards and descendants: $.a.b, $['a'], $.a[0], $.a[*], $.a.*, $..a
+func parseJSONPath(expression string) (jsonPath, error) {
+	if !strings.HasPrefix(expression, "$") {
+		return nil, fmt.Errorf("a JSONPath starts with $")
+	}
+
+	var path jsonPath
+	rest := expression[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			name, remaining := cutJSONPathName(rest[2:])
+			if name == "" {
+				return nil, fmt.Errorf("missing field name after .. in %q", expression)
+			}
+			path = append(path, jsonPathSegment{kind: jsonPathDescendant, name: name})
+			rest = remaining
+		case strings.HasPrefix(rest, ".*"):
+			path = append(path, jsonPathSegment{kind: jsonPathWildcard})
+			rest = rest[2:]
+		case rest[0] == '.':
+			name, remaining := cutJSONPathName(rest[1:])
+			if name == "" {
+				return nil, fmt.Errorf("missing field name after . in %q", expression)
+			}
+			path = append(path, jsonPathSegment{kind: jsonPathField, name: name})
+			rest = remaining
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %q", expression)
+			}
+			segment, err := parseJSONPathBracket(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("%s in %q", err, expression)
+			}
+			path = append(path, segment)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", rest[0], expression)
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("the whole body cannot be redacted by field, use the body redacts")
+	}
+	return path, nil
+}
+
+// cutJSONPathName splits a field name from the rest of the path
+func cutJSONPathName(path string) (string, string) {
+	end := strings.IndexAny(path, ".[")
+	if end < 0 {
+		return path, ""
+	}
+	return path[:end], path[end:]
+}
+
+func parseJSONPathBracket(content string) (jsonPathSegment, error) {
+	if content == "*" {
+		return jsonPathSegment{kind: jsonPathWildcard}, nil
+	}
+	if len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0] {
+		return jsonPathSegment{kind: jsonPathField, name: content[1 : len(content)-1]}, nil
+	}
+	index, err := strconv.Atoi(content)
+	if err != nil {
+		return jsonPathSegment{}, fmt.Errorf("invalid index [%s]", content)
+	}
+	return jsonPathSegment{kind: jsonPathIndex, index: index}, nil
+}
+
+// redactJSONPath replaces the values matching the path with the redact marker.
+// Returns whether something was redacted.
+func redactJSONPath(value interface{}, path jsonPath) bool {
+	if len(path) == 0 {
+		return false
+	}
+	segment, rest := path[0], path[1:]
+
+	redacted := false
+	// 路径的最后一段直接替换，其它段继续向下查找
+	apply := func(child interface{}, replace func(interface{})) {
+		if len(rest) == 0 {
+			replace(redactedValue)
+			redacted = true
+		} else if redactJSONPath(child, rest) {
+			redacted = true
+		}
+	}
+
+	switch segment.kind {
+	case jsonPathField:
+		if object, ok := value.(map[string]interface{}); ok {
+			if child, found := object[segment.name]; found {
+				apply(child, func(v interface{}) { object[segment.name] = v })
+			}
+		}
+	case jsonPathIndex:
+		if array, ok := value.([]interface{}); ok {
+			index := segment.index
+			if index < 0 {
+				index += len(array)
+			}
+			if index >= 0 && index < len(array) {
+				apply(array[index], func(v interface{}) { array[index] = v })
+			}
+		}
+	case jsonPathWildcard:
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				key := key
+				apply(child, func(r interface{}) { v[key] = r })
+			}
+		case []interface{}:
+			for i, child := range v {
+				i := i
+				apply(child, func(r interface{}) { v[i] = r })
+			}
+		}
+	case jsonPathDescendant:
+		field := append(jsonPath{{kind: jsonPathField, name: segment.name}}, rest...)
+		if redactJSONPath(value, field) {
+			redacted = true
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for _, child := range v {
+				if redactJSONPath(child, path) {
+					redacted = true
+				}
+			}
+		case []interface{}:
+			for _, child := range v {
+				if redactJSONPath(child, path) {
+					redacted = true
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+// redactJSONText redacts the paths in a JSON text.
+// Returns false when the text is not JSON.
+func redactJSONText(text string, paths []jsonPath) (string, bool) {
+	// 保留数字的原始写法，避免大整数丢失精度
+	value, ok := parseJSONValue(text)
+	if !ok {
+		return text, false
+	}
+
+	redacted := false
+	for _, path := range paths {
+		if redactJSONPath(value, path) {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return text, true
+	}
+
+	redactedText, err := encodeJSON(value)
+	if err != nil {
+		return redactedValue, true
+	}
+	return redactedText, true
+}
+
+// redactBodyFields redacts the paths in a JSON body, in each line of an NDJSON body
+// or in each data line of an event stream. The JSON that does not parse, like a body
+// cut by the capture limit, cannot be redacted by field and is replaced as a whole.
+func redactBodyFields(text, contentType string, paths []jsonPath) string {
+	if redactedText, ok := redactJSONText(text, paths); ok {
+		return redactedText
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case isNDJSONContentType(mediaType):
+		return redactLines(text, "", paths)
+	case isEventStream(contentType) || looksLikeEventStream(text):
+		return redactLines(text, "data:", paths)
+	case looksLikeJSON(text, mediaType):
+		return redactedValue
+	default:
+		return text
+	}
+}
+
+// redactLines redacts the JSON of each line starting with the prefix
+func redactLines(text, prefix string, paths []jsonPath) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		data, found := strings.CutPrefix(line, prefix)
+		data = strings.TrimSpace(data)
+		if !found || data == "" {
+			continue
+		}
+		redactedData, ok := redactJSONText(data, paths)
+		if !ok {
+			// 事件流中的 [DONE] 之类的文本原样保留，截断的对象整体替换
+			if !strings.HasPrefix(data, "{") && (prefix != "" || !strings.HasPrefix(data, "[")) {
+				continue
+			}
+			redactedData = redactedValue
+		}
+		if prefix != "" {
+			redactedData = prefix + " " + redactedData
+		}
+		lines[i] = redactedData
+	}
+	return strings.Join(lines, "\n")
+}
+
+// looksLikeJSON tells whether a body that does not parse was meant to be JSON
+func looksLikeJSON(text, mediaType string) bool {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return false
+	}
+	return isJSONContentType(mediaType) || trimmed[0] == '{' || trimmed[0] == '['
+}
+
+// RedactingHTTPDecoder redacts fields of the JSON body decoded by another decoder.
+type RedactingHTTPDecoder struct {
+	decoder     HTTPBodyDecoder
+	contentType string
+	paths       []jsonPath
+}
+
+func (d *RedactingHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	// 截断的 body 解码出错时仍会返回部分内容，同样需要脱敏
+	text, err := d.decoder.decode(content)
+	return redactBodyFields(text, d.contentType, d.paths), err
+}
@@ -0,0 +1,19 @@
+package log2fuse
+
+import (
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// transcodeCharset converts a body from the charset declared in its content type to UTF-8.
+// The charset names and aliases are the ones of the WHATWG Encoding Standard, like the
+// browsers do ISO-8859-1 is read as its Windows-1252 superset.
+func transcodeCharset(text, charset string) (string, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return text, err
+	}
+	if name, _ := htmlindex.Name(encoding); name == "utf-8" {
+		return text, nil
+	}
+	return encoding.NewDecoder().String(text)
+}
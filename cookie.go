@@ -0,0 +1,66 @@
+package log2fuse
+
+import (
+	"strings"
+)
+
+// cookieFilter redacts the values of the sensitive cookies of the Cookie and Set-Cookie headers.
+//
+// A cookie keeps its value when it is in the allow list, or when the allow list is empty,
+// and it is not in the deny list. Names are case-insensitive, a trailing * matches a prefix.
+type cookieFilter struct {
+	allow []string
+	deny  []string
+}
+
+func (f *cookieFilter) enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+// keeps tells whether the value of a cookie can be logged
+func (f *cookieFilter) keeps(name string) bool {
+	if matchCookieName(f.deny, name) {
+		return false
+	}
+	return len(f.allow) == 0 || matchCookieName(f.allow, name)
+}
+
+// redactCookie filters the cookies of a Cookie header value: "a=1; b=2"
+func (f *cookieFilter) redactCookie(value string) string {
+	cookies := strings.Split(value, ";")
+	for i, cookie := range cookies {
+		cookies[i] = f.redactPair(cookie)
+	}
+	return strings.Join(cookies, ";")
+}
+
+// redactSetCookie filters the cookie of a Set-Cookie header value, its attributes are kept as is
+func (f *cookieFilter) redactSetCookie(value string) string {
+	pair, attributes, found := strings.Cut(value, ";")
+	if !found {
+		return f.redactPair(pair)
+	}
+	return f.redactPair(pair) + ";" + attributes
+}
+
+// redactPair redacts the value of a name=value pair, keeping the spaces around it
+func (f *cookieFilter) redactPair(pair string) string {
+	name, value, found := strings.Cut(pair, "=")
+	if !found || f.keeps(strings.TrimSpace(name)) {
+		return pair
+	}
+	return name + "=" + redact(strings.TrimSpace(value))
+}
+
+func matchCookieName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
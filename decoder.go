@@ -5,46 +5,109 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/lzw"
+	"errors"
 	"io"
 	"log"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/peace0phmind/log2fuse/zstd"
 )
 
+// errBodyTruncated is returned with the beginning of a body whose decoded size exceeds the capture limit
+var errBodyTruncated = errors.New("decoded body exceeds the capture limit")
+
 // HTTPBodyDecoderFactory selects which decoder should run.
 type HTTPBodyDecoderFactory struct {
-	rawDecoder         *RawHTTPDecoder
-	gzipDecoder        *GZipHTTPDecoder
-	compressDecoder    *CompressHTTPDecoder
-	deflateHTTPDecoder *DeflateHTTPDecoder
+	rawDecoder *RawHTTPDecoder
+	logger     *log.Logger
 }
 
-func (f *HTTPBodyDecoderFactory) create(encoding string) HTTPBodyDecoder {
-	if encoding == "gzip" {
-		return f.gzipDecoder
+// create returns the decoder of a Content-Encoding. Stacked encodings like
+// "gzip, br" were applied in order, so they are decoded in reverse order.
+// The decompressed output is bounded to maxBytes, a zero maxBytes means no limit.
+func (f *HTTPBodyDecoderFactory) create(encoding string, maxBytes int) HTTPBodyDecoder {
+	var decoders []HTTPBodyDecoder
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		decoder := f.createSingle(coding, maxBytes)
+		if decoder == nil {
+			return f.rawDecoder // any unsupported encoding
+		}
+		decoders = append(decoders, decoder)
 	}
-	if encoding == "compress" {
-		return f.compressDecoder
+
+	switch len(decoders) {
+	case 0:
+		return f.rawDecoder
+	case 1:
+		return decoders[0]
+	default:
+		return &StackedHTTPDecoder{decoders: decoders}
+	}
+}
+
+func (f *HTTPBodyDecoderFactory) createSingle(coding string, maxBytes int) HTTPBodyDecoder {
+	switch coding {
+	case "gzip", "x-gzip":
+		return &GZipHTTPDecoder{logger: f.logger, maxBytes: maxBytes}
+	case "compress", "x-compress":
+		return &CompressHTTPDecoder{logger: f.logger, maxBytes: maxBytes}
+	case "deflate":
+		return &DeflateHTTPDecoder{logger: f.logger, maxBytes: maxBytes}
+	case "br":
+		return &BrotliHTTPDecoder{logger: f.logger, maxBytes: maxBytes}
+	case "zstd":
+		return &ZstdHTTPDecoder{logger: f.logger, maxBytes: maxBytes}
+	default:
+		return nil
 	}
-	if encoding == "deflate" {
-		return f.deflateHTTPDecoder
+}
+
+// createContent wraps the decoder of a Content-Encoding with the handling of the Content-Type.
+func (f *HTTPBodyDecoderFactory) createContent(decoder HTTPBodyDecoder, contentType string, base64MaxBytes int) HTTPBodyDecoder {
+	return &ContentHTTPDecoder{
+		decoder:        decoder,
+		contentType:    contentType,
+		base64MaxBytes: base64MaxBytes,
+		logger:         f.logger,
 	}
-	return f.rawDecoder // identity and any unsupported encoding
 }
 
 func createHTTPBodyDecoderFactory(logger *log.Logger) *HTTPBodyDecoderFactory {
 	return &HTTPBodyDecoderFactory{
-		rawDecoder:         &RawHTTPDecoder{},
-		gzipDecoder:        &GZipHTTPDecoder{logger: logger},
-		compressDecoder:    &CompressHTTPDecoder{logger: logger},
-		deflateHTTPDecoder: &DeflateHTTPDecoder{logger: logger},
+		rawDecoder: &RawHTTPDecoder{},
+		logger:     logger,
 	}
 }
 
 // HTTPBodyDecoder a body decoder strategy.
 type HTTPBodyDecoder interface {
-	// decodes the content
+	// decodes the content without consuming it, so that every logger can decode it
 	decode(content *bytes.Buffer) (string, error)
 }
 
+// readDecoded reads a decoded body. A body cut by the capture limit ends
+// unexpectedly, the part decoded until then is still returned. The output is
+// bounded to maxBytes, so that a compression bomb cannot exhaust the memory.
+func readDecoded(reader io.Reader, encoding string, maxBytes int, logger *log.Logger) (string, error) {
+	if maxBytes > 0 {
+		reader = io.LimitReader(reader, int64(maxBytes)+1)
+	}
+	result, err := io.ReadAll(reader)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.Printf("Failed to read %s: %s", encoding, err)
+	}
+	if maxBytes > 0 && len(result) > maxBytes {
+		return string(result[:maxBytes]), errBodyTruncated
+	}
+	return string(result), err
+}
+
 // RawHTTPDecoder just returns the content as-is.
 type RawHTTPDecoder struct{}
 
@@ -54,52 +117,87 @@ func (d *RawHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
 
 // GZipHTTPDecoder extracts the Lempel-Ziv coding (LZ77) with a 32-bit CRC.
 type GZipHTTPDecoder struct {
-	logger *log.Logger
+	logger   *log.Logger
+	maxBytes int
 }
 
 func (d *GZipHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
-	gzReader, err := gzip.NewReader(content)
+	gzReader, err := gzip.NewReader(bytes.NewReader(content.Bytes()))
 	if err != nil {
 		d.logger.Printf("Failed to create gzip reader: %s", err)
 		return "", err
 	}
 	defer tryClose(gzReader, d.logger)
-	result, err := io.ReadAll(gzReader)
-	if err != nil {
-		d.logger.Printf("Failed to read gzip: %s", err)
-		return "", err
-	}
-	return string(result), nil
+	return readDecoded(gzReader, "gzip", d.maxBytes, d.logger)
 }
 
 // CompressHTTPDecoder extracts with the Lempel-Ziv-Welch (LZW) algorithm.
 type CompressHTTPDecoder struct {
-	logger *log.Logger
+	logger   *log.Logger
+	maxBytes int
 }
 
 func (d *CompressHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
-	reader := lzw.NewReader(content, lzw.MSB, 8)
+	reader := lzw.NewReader(bytes.NewReader(content.Bytes()), lzw.MSB, 8)
 	defer tryClose(reader, d.logger)
-	result, err := io.ReadAll(reader)
-	if err != nil {
-		d.logger.Printf("Failed to read compress: %s", err)
-		return "", err
-	}
-	return string(result), nil
+	return readDecoded(reader, "compress", d.maxBytes, d.logger)
 }
 
 // DeflateHTTPDecoder extracts the zlib structure with the deflate compression algorithm.
 type DeflateHTTPDecoder struct {
-	logger *log.Logger
+	logger   *log.Logger
+	maxBytes int
 }
 
 func (d *DeflateHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
-	reader := flate.NewReader(content)
+	reader := flate.NewReader(bytes.NewReader(content.Bytes()))
 	defer tryClose(reader, d.logger)
-	result, err := io.ReadAll(reader)
-	if err != nil {
-		d.logger.Printf("Failed to read deflate: %s", err)
-		return "", err
+	return readDecoded(reader, "deflate", d.maxBytes, d.logger)
+}
+
+// BrotliHTTPDecoder extracts the brotli compression (RFC 7932).
+type BrotliHTTPDecoder struct {
+	logger   *log.Logger
+	maxBytes int
+}
+
+func (d *BrotliHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	return readDecoded(brotli.NewReader(bytes.NewReader(content.Bytes())), "brotli", d.maxBytes, d.logger)
+}
+
+// ZstdHTTPDecoder extracts the Zstandard compression (RFC 8878).
+type ZstdHTTPDecoder struct {
+	logger   *log.Logger
+	maxBytes int
+}
+
+func (d *ZstdHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	return readDecoded(zstd.NewReader(bytes.NewReader(content.Bytes())), "zstd", d.maxBytes, d.logger)
+}
+
+// StackedHTTPDecoder runs several decoders, each one on the output of the previous one.
+type StackedHTTPDecoder struct {
+	decoders []HTTPBodyDecoder
+}
+
+func (d *StackedHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	current := content
+	var text string
+	var firstErr error
+	truncated := false
+	for _, decoder := range d.decoders {
+		decoded, err := decoder.decode(current)
+		if errors.Is(err, errBodyTruncated) {
+			truncated = true
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		// 截断的内容继续交给下一层解码，尽量多还原一些
+		text = decoded
+		current = bytes.NewBufferString(text)
+	}
+	if truncated {
+		return text, errBodyTruncated
 	}
-	return string(result), nil
+	return text, firstErr
 }
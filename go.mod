@@ -1,3 +1,7 @@
 module github.com/peace0phmind/log2fuse
 
 go 1.22
+
+require github.com/andybalholm/brotli v1.1.1
+
+require golang.org/x/text v0.21.0
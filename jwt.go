@@ -1,7 +1,11 @@
 package log2fuse
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"strings"
 )
 
@@ -13,13 +17,14 @@ func decodeJWTHeader(value string) string {
 	} else {
 		token = value
 	}
+	// a value that is not a JWT is redacted, it may still be a credential
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return value
+		return redactJWTHeader(value)
 	}
 	decodedParts, err := decodeEach(parts[0:2], base64Decode)
 	if err != nil {
-		return value
+		return redactJWTHeader(value)
 	}
 	if withBearer {
 		return "Bearer " + strings.Join(decodedParts, ".")
@@ -34,3 +39,69 @@ func base64Decode(encodedString string) (string, error) {
 	}
 	return string(decodedBytes), nil
 }
+
+// jwtClaims decodes the payload of a JWT, with or without the Bearer prefix.
+// The signature is not verified.
+func jwtClaims(value string) (map[string]interface{}, bool) {
+	token := strings.TrimSpace(value)
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64Decode(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// redactJWTHeader replaces the token, keeping the authentication scheme
+func redactJWTHeader(value string) string {
+	if scheme, token, ok := strings.Cut(strings.TrimSpace(value), " "); ok && token != "" {
+		return scheme + " " + redact(token)
+	}
+	return redact(value)
+}
+
+// filterJWTClaims keeps the allowed claims, nested claims written as a.b.
+// The other top-level claims are dropped, or replaced by their HMAC-SHA256 keyed
+// with salt when hash is set, so that the claims cannot be guessed back.
+func filterJWTClaims(claims map[string]interface{}, allowed []string, hash bool, salt []byte) map[string]interface{} {
+	filtered := make(map[string]interface{})
+	for _, path := range allowed {
+		if value, ok := lookupField(claims, path); ok {
+			filtered[path] = value
+		}
+	}
+	if !hash {
+		return filtered
+	}
+
+	for key, value := range claims {
+		if isAllowedClaim(key, allowed) {
+			continue
+		}
+		data, _ := json.Marshal(value)
+		mac := hmac.New(sha256.New, salt)
+		mac.Write(data)
+		filtered[key] = hmacPrefix + hex.EncodeToString(mac.Sum(nil))
+	}
+	return filtered
+}
+
+// isAllowedClaim tells whether a top-level claim is kept, entirely or in part
+func isAllowedClaim(key string, allowed []string) bool {
+	for _, path := range allowed {
+		if path == key || strings.HasPrefix(path, key+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+package langfuse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxBatchBytes keeps ingestion requests under the 3.5 MB limit of the ingestion API
+const DefaultMaxBatchBytes = 3 * 1024 * 1024
+
+// minTruncatedStringLength is the length under which strings are no longer shortened
+const minTruncatedStringLength = 256
+
+// ErrPayloadTooLarge is returned when the server rejects a request as too large
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrEventTooLarge is returned when an event cannot be brought under the size limit
+var ErrEventTooLarge = errors.New("event too large")
+
+// OversizePolicy decides what happens to a single event larger than the size limit
+type OversizePolicy string
+
+const (
+	// OversizePolicyTruncate shortens the long strings of the event input, output and metadata
+	OversizePolicyTruncate OversizePolicy = "truncate"
+	// OversizePolicyOffload stores the full event with the Offloader and sends a reference instead
+	OversizePolicyOffload OversizePolicy = "offload"
+)
+
+// Offloader stores an event elsewhere and returns a reference to it
+type Offloader interface {
+	Offload(ctx context.Context, event IngestionEvent) (string, error)
+}
+
+// DirectoryOffloader writes offloaded events as JSON files into a directory.
+// The files older than Retention are removed, then the oldest files until the
+// directory fits in MaxBytes; a zero Retention or MaxBytes means no limit.
+type DirectoryOffloader struct {
+	Dir       string
+	MaxBytes  int64
+	Retention time.Duration
+}
+
+// Offload writes the event to <Dir>/<event id>.json
+func (o *DirectoryOffloader) Offload(_ context.Context, event IngestionEvent) (string, error) {
+	if err := os.MkdirAll(o.Dir, 0o750); err != nil {
+		return "", fmt.Errorf("failed to create offload directory: %w", err)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal event: %w", err)
+	}
+	path := filepath.Join(o.Dir, filepath.Base(event.ID)+".json")
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		return "", fmt.Errorf("failed to write offloaded event: %w", err)
+	}
+	o.enforceLimits(path)
+	return path, nil
+}
+
+// enforceLimits removes the expired and the oldest offloaded events, keeping the
+// one just written. It is best effort, a file that cannot be removed is left.
+func (o *DirectoryOffloader) enforceLimits(written string) {
+	if o.MaxBytes <= 0 && o.Retention <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return
+	}
+	type offloadedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []offloadedFile
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, offloadedFile{path: filepath.Join(o.Dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	now := time.Now()
+	for _, file := range files {
+		expired := o.Retention > 0 && now.Sub(file.modTime) > o.Retention
+		oversized := o.MaxBytes > 0 && total > o.MaxBytes
+		if file.path == written || !expired && !oversized {
+			continue
+		}
+		if err := os.Remove(file.path); err == nil || os.IsNotExist(err) {
+			total -= file.size
+		}
+	}
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithMaxBatchBytes sets the maximum serialized size of one ingestion request
+func WithMaxBatchBytes(maxBatchBytes int) ClientOption {
+	return func(c *Client) {
+		if maxBatchBytes > 0 {
+			c.maxBatchBytes = maxBatchBytes
+		}
+	}
+}
+
+// WithOversizePolicy sets what happens to an event larger than the size limit
+func WithOversizePolicy(policy OversizePolicy) ClientOption {
+	return func(c *Client) {
+		c.oversizePolicy = policy
+	}
+}
+
+// WithOffloader sets where oversized events go with OversizePolicyOffload
+func WithOffloader(offloader Offloader) ClientOption {
+	return func(c *Client) {
+		c.offloader = offloader
+	}
+}
+
+// sizedEvent is an event with its serialized size
+type sizedEvent struct {
+	event IngestionEvent
+	size  int
+}
+
+// splitBatch groups the events into batches whose serialized request stays
+// under maxBatchBytes. Oversized events are truncated or offloaded first;
+// the events that still do not fit are left out and returned as rejected,
+// so that they do not fail the rest of the batch.
+func (c *Client) splitBatch(ctx context.Context, req *IngestionRequest) ([][]IngestionEvent, []IngestionError, error) {
+	envelope, err := json.Marshal(&IngestionRequest{Batch: []IngestionEvent{}, Metadata: req.Metadata})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal request metadata: %w", err)
+	}
+	eventLimit := c.maxBatchBytes - len(envelope)
+
+	var batches [][]IngestionEvent
+	var rejected []IngestionError
+	var current []IngestionEvent
+	currentSize := len(envelope)
+
+	for _, event := range req.Batch {
+		sized, err := c.fitEvent(ctx, event, eventLimit)
+		if errors.Is(err, ErrEventTooLarge) {
+			rejected = append(rejected, IngestionError{ID: event.ID, Status: http.StatusRequestEntityTooLarge, Message: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// 事件之间的逗号
+		separator := 0
+		if len(current) > 0 {
+			separator = 1
+		}
+		if len(current) > 0 && currentSize+separator+sized.size > c.maxBatchBytes {
+			batches = append(batches, current)
+			current = nil
+			currentSize = len(envelope)
+			separator = 0
+		}
+		current = append(current, sized.event)
+		currentSize += separator + sized.size
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches, rejected, nil
+}
+
+// fitEvent returns the event, reduced according to the oversize policy when
+// it is larger than limit. If it cannot be reduced an ErrEventTooLarge error is returned.
+func (c *Client) fitEvent(ctx context.Context, event IngestionEvent, limit int) (sizedEvent, error) {
+	size, err := serializedSize(event)
+	if err != nil {
+		return sizedEvent{}, err
+	}
+	if size <= limit {
+		return sizedEvent{event: event, size: size}, nil
+	}
+
+	if c.oversizePolicy == OversizePolicyOffload && c.offloader != nil {
+		reference, err := c.offloader.Offload(ctx, event)
+		if err == nil {
+			offloaded := replacePayload(event, map[string]interface{}{
+				"offloaded":    reference,
+				"originalSize": size,
+			})
+			if offloadedSize, err := serializedSize(offloaded); err == nil && offloadedSize <= limit {
+				return sizedEvent{event: offloaded, size: offloadedSize}, nil
+			}
+		}
+		// 卸载失败时退回到截断
+	}
+
+	return truncateEvent(event, size, limit)
+}
+
+// payloadFields are the event body fields that may be truncated or offloaded
+var payloadFields = []string{"input", "output", "metadata"}
+
+// truncateEvent shortens the long strings of the payload fields, halving the
+// maximum string length until the event fits, then falls back to a summary.
+func truncateEvent(event IngestionEvent, size, limit int) (sizedEvent, error) {
+	for maxLength := limit / 2; maxLength >= minTruncatedStringLength; maxLength /= 2 {
+		body := make(map[string]interface{}, len(event.Body))
+		for key, value := range event.Body {
+			body[key] = value
+		}
+		for _, field := range payloadFields {
+			if value, ok := body[field]; ok {
+				body[field] = truncateStrings(value, maxLength)
+			}
+		}
+
+		truncated := event
+		truncated.Body = body
+		truncatedSize, err := serializedSize(truncated)
+		if err != nil {
+			return sizedEvent{}, err
+		}
+		if truncatedSize <= limit {
+			return sizedEvent{event: truncated, size: truncatedSize}, nil
+		}
+	}
+
+	summary := replacePayload(event, map[string]interface{}{
+		"truncated":    true,
+		"originalSize": size,
+	})
+	summarySize, err := serializedSize(summary)
+	if err != nil {
+		return sizedEvent{}, err
+	}
+	if summarySize <= limit {
+		return sizedEvent{event: summary, size: summarySize}, nil
+	}
+
+	return sizedEvent{}, fmt.Errorf("%w: event %s of %d bytes exceeds %d bytes", ErrEventTooLarge, event.ID, size, limit)
+}
+
+// truncateStrings returns a copy of value with the strings longer than maxLength shortened
+func truncateStrings(value interface{}, maxLength int) interface{} {
+	switch v := value.(type) {
+	case string:
+		if len(v) <= maxLength {
+			return v
+		}
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(v[cut]) {
+			cut--
+		}
+		return fmt.Sprintf("%s...[truncated %d bytes]", v[:cut], len(v)-cut)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = truncateStrings(item, maxLength)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = truncateStrings(item, maxLength)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// replacePayload returns a copy of the event whose payload fields are replaced by a note
+func replacePayload(event IngestionEvent, note map[string]interface{}) IngestionEvent {
+	body := make(map[string]interface{}, len(event.Body))
+	for key, value := range event.Body {
+		body[key] = value
+	}
+	for _, field := range payloadFields {
+		if _, ok := body[field]; ok {
+			body[field] = note
+		}
+	}
+	replaced := event
+	replaced.Body = body
+	return replaced
+}
+
+func serializedSize(event IngestionEvent) (int, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal event %s: %w", event.ID, err)
+	}
+	return len(data), nil
+}
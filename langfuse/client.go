@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,18 +17,28 @@ type Client struct {
 	httpClient *http.Client
 	username   string // Langfuse Public Key
 	password   string // Langfuse Secret Key
+
+	maxBatchBytes  int
+	oversizePolicy OversizePolicy
+	offloader      Offloader
 }
 
 // NewClient creates a new Langfuse API client
-func NewClient(baseURL, publicKey, secretKey string) *Client {
-	return &Client{
+func NewClient(baseURL, publicKey, secretKey string, opts ...ClientOption) *Client {
+	c := &Client{
 		baseURL: baseURL,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		username: publicKey,
-		password: secretKey,
+		username:       publicKey,
+		password:       secretKey,
+		maxBatchBytes:  DefaultMaxBatchBytes,
+		oversizePolicy: OversizePolicyTruncate,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
 // HealthResponse represents the health check response
@@ -119,10 +130,19 @@ const (
 type ObservationType string
 
 const (
-	ObservationTypeSpan  ObservationType = "SPAN"
-	ObservationTypeEvent ObservationType = "EVENT"
+	ObservationTypeSpan       ObservationType = "SPAN"
+	ObservationTypeEvent      ObservationType = "EVENT"
+	ObservationTypeGeneration ObservationType = "GENERATION"
 )
 
+// Usage represents the usage of a generation
+type Usage struct {
+	Input  int    `json:"input,omitempty"`
+	Output int    `json:"output,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+}
+
 // ObservationBody represents the body of an observation
 type ObservationBody struct {
 	ID                  string                 `json:"id,omitempty"`
@@ -142,6 +162,8 @@ type ObservationBody struct {
 	StatusMessage       string                 `json:"statusMessage,omitempty"`
 	ParentObservationID string                 `json:"parentObservationId,omitempty"`
 	Environment         string                 `json:"environment,omitempty"`
+	Usage               *Usage                 `json:"usage,omitempty"`
+	UsageDetails        map[string]int         `json:"usageDetails,omitempty"`
 }
 
 // SDKLogBody represents the body of an SDK log event
@@ -179,13 +201,13 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body interf
 func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
 	resp, err := c.doRequest(ctx, "GET", "/api/public/health", nil)
 	if err != nil {
-		return nil, fmt.Errorf("health check failed: %w", err)
+		return nil, fmt.Errorf("health check failed: %w", &NetworkError{Err: err})
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("health check failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("health check failed: %w", newAPIError(resp, body, time.Now()))
 	}
 
 	var healthResp HealthResponse
@@ -196,18 +218,81 @@ func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
 	return &healthResp, nil
 }
 
-// Ingest sends a batch of tracing events to be ingested
+// Ingest sends a batch of tracing events to be ingested.
+// The batch is split into several requests when its serialized size exceeds
+// the client limit; the responses of all requests are merged. An event that
+// cannot be brought under the limit is reported in the errors of the response.
+// When a request fails after others were sent, the merged response is returned
+// with a *PartialIngestionError listing the events that were not sent.
 func (c *Client) Ingest(ctx context.Context, req *IngestionRequest) (*IngestionResponse, error) {
-	resp, err := c.doRequest(ctx, "POST", "/api/public/ingestion", req)
+	batches, rejected, err := c.splitBatch(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("ingestion failed: %w", err)
 	}
+
+	result := &IngestionResponse{Errors: rejected}
+	sent := false
+	for i, batch := range batches {
+		resp, unsent, err := c.ingestSplitting(ctx, &IngestionRequest{Batch: batch, Metadata: req.Metadata})
+		if resp != nil {
+			result.Successes = append(result.Successes, resp.Successes...)
+			result.Errors = append(result.Errors, resp.Errors...)
+			sent = true
+		}
+		if err != nil {
+			if !sent && len(rejected) == 0 {
+				return nil, err
+			}
+			for _, rest := range batches[i+1:] {
+				unsent = append(unsent, rest...)
+			}
+			return result, &PartialIngestionError{Unsent: unsent, Err: err}
+		}
+	}
+
+	return result, nil
+}
+
+// ingestSplitting sends the request and halves it while the server answers 413.
+// Returns the merged responses of the requests that were sent and, on failure,
+// the events that were not.
+func (c *Client) ingestSplitting(ctx context.Context, req *IngestionRequest) (*IngestionResponse, []IngestionEvent, error) {
+	resp, err := c.ingest(ctx, req)
+	if err == nil {
+		return resp, nil, nil
+	}
+	if !errors.Is(err, ErrPayloadTooLarge) || len(req.Batch) < 2 {
+		return nil, append([]IngestionEvent{}, req.Batch...), err
+	}
+
+	half := len(req.Batch) / 2
+	first, unsent, err := c.ingestSplitting(ctx, &IngestionRequest{Batch: req.Batch[:half], Metadata: req.Metadata})
+	if err != nil {
+		return first, append(unsent, req.Batch[half:]...), err
+	}
+	second, unsent, err := c.ingestSplitting(ctx, &IngestionRequest{Batch: req.Batch[half:], Metadata: req.Metadata})
+	if second == nil {
+		return first, unsent, err
+	}
+	return &IngestionResponse{
+		Successes: append(first.Successes, second.Successes...),
+		Errors:    append(first.Errors, second.Errors...),
+	}, unsent, err
+}
+
+// ingest sends a single ingestion request.
+// Failures are reported as *NetworkError or *APIError, see IsRetryable.
+func (c *Client) ingest(ctx context.Context, req *IngestionRequest) (*IngestionResponse, error) {
+	resp, err := c.doRequest(ctx, "POST", "/api/public/ingestion", req)
+	if err != nil {
+		return nil, fmt.Errorf("ingestion failed: %w", &NetworkError{Err: err})
+	}
 	defer resp.Body.Close()
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to read response body: %w", &NetworkError{Err: err})
 	}
 
 	// Handle 207 status code (partial success)
@@ -219,9 +304,9 @@ func (c *Client) Ingest(ctx context.Context, req *IngestionRequest) (*IngestionR
 		return &ingestionResp, nil
 	}
 
-	// Handle other status codes
+	// Handle other status codes, a 413 matches ErrPayloadTooLarge
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("ingestion failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("ingestion of %d events failed: %w", len(req.Batch), newAPIError(resp, body, time.Now()))
 	}
 
 	var ingestionResp IngestionResponse
@@ -264,6 +349,26 @@ func UpdateSpanEvent(id, timestamp string, body *ObservationBody) *IngestionEven
 	}
 }
 
+// CreateGenerationEvent creates a generation-create event
+func CreateGenerationEvent(id, timestamp string, body *ObservationBody) *IngestionEvent {
+	return &IngestionEvent{
+		ID:        id,
+		Timestamp: timestamp,
+		Type:      "generation-create",
+		Body:      structToMap(body),
+	}
+}
+
+// UpdateGenerationEvent creates a generation-update event
+func UpdateGenerationEvent(id, timestamp string, body *ObservationBody) *IngestionEvent {
+	return &IngestionEvent{
+		ID:        id,
+		Timestamp: timestamp,
+		Type:      "generation-update",
+		Body:      structToMap(body),
+	}
+}
+
 // CreateEventEvent creates an event-create event
 func CreateEventEvent(id, timestamp string, body *ObservationBody) *IngestionEvent {
 	return &IngestionEvent{
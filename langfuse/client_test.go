@@ -2,7 +2,15 @@ package langfuse
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -315,3 +323,296 @@ func TestCreateSDKLogEvent(t *testing.T) {
 		t.Errorf("期望事件类型为 sdk-log, 实际为 %s", event.Type)
 	}
 }
+
+// ingestionRecorder 记录收到的每个 ingestion 请求
+type ingestionRecorder struct {
+	mu       sync.Mutex
+	requests [][]byte
+	maxBytes int
+}
+
+func newIngestionServer(t *testing.T, recorder *ingestionRecorder) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if recorder.maxBytes > 0 && len(body) > recorder.maxBytes {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		recorder.mu.Lock()
+		recorder.requests = append(recorder.requests, body)
+		recorder.mu.Unlock()
+
+		var ingestionReq IngestionRequest
+		_ = json.Unmarshal(body, &ingestionReq)
+		resp := IngestionResponse{Successes: []IngestionSuccess{}, Errors: []IngestionError{}}
+		for _, event := range ingestionReq.Batch {
+			resp.Successes = append(resp.Successes, IngestionSuccess{ID: event.ID, Status: http.StatusCreated})
+		}
+		rw.WriteHeader(http.StatusMultiStatus)
+		_ = json.NewEncoder(rw).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func createLargeEvent(id string, inputSize int) IngestionEvent {
+	return *CreateSpanEvent(id, "2023-01-01T00:00:00Z", &ObservationBody{
+		ID:    id,
+		Type:  ObservationTypeSpan,
+		Input: map[string]interface{}{"body": strings.Repeat("x", inputSize)},
+	})
+}
+
+func TestIngestSplitsBatch(t *testing.T) {
+	recorder := &ingestionRecorder{}
+	server := newIngestionServer(t, recorder)
+	client := NewClient(server.URL, "pk", "sk", WithMaxBatchBytes(2000))
+
+	var batch []IngestionEvent
+	for i := 0; i < 5; i++ {
+		batch = append(batch, createLargeEvent(fmt.Sprintf("event-%d", i), 600))
+	}
+
+	resp, err := client.Ingest(context.Background(), &IngestionRequest{Batch: batch})
+	if err != nil {
+		t.Fatalf("发送事件失败: %v", err)
+	}
+	if len(resp.Successes) != 5 {
+		t.Errorf("期望成功事件数为 5, 实际为 %d", len(resp.Successes))
+	}
+	if len(recorder.requests) < 2 {
+		t.Errorf("期望拆分为多个请求, 实际为 %d", len(recorder.requests))
+	}
+	for _, request := range recorder.requests {
+		if len(request) > 2000 {
+			t.Errorf("请求大小 %d 超过限制 2000", len(request))
+		}
+	}
+}
+
+func TestIngestTruncatesOversizedEvent(t *testing.T) {
+	recorder := &ingestionRecorder{}
+	server := newIngestionServer(t, recorder)
+	client := NewClient(server.URL, "pk", "sk", WithMaxBatchBytes(4000))
+
+	_, err := client.Ingest(context.Background(), &IngestionRequest{Batch: []IngestionEvent{createLargeEvent("big", 20000)}})
+	if err != nil {
+		t.Fatalf("发送事件失败: %v", err)
+	}
+	if len(recorder.requests) != 1 || len(recorder.requests[0]) > 4000 {
+		t.Fatalf("期望一个不超过限制的请求, 实际为 %d 个", len(recorder.requests))
+	}
+	if !strings.Contains(string(recorder.requests[0]), "[truncated") {
+		t.Errorf("期望事件被截断: %s", recorder.requests[0])
+	}
+}
+
+func TestIngestOffloadsOversizedEvent(t *testing.T) {
+	recorder := &ingestionRecorder{}
+	server := newIngestionServer(t, recorder)
+	dir := t.TempDir()
+	client := NewClient(server.URL, "pk", "sk", WithMaxBatchBytes(4000),
+		WithOversizePolicy(OversizePolicyOffload), WithOffloader(&DirectoryOffloader{Dir: dir}))
+
+	_, err := client.Ingest(context.Background(), &IngestionRequest{Batch: []IngestionEvent{createLargeEvent("big", 20000)}})
+	if err != nil {
+		t.Fatalf("发送事件失败: %v", err)
+	}
+	if !strings.Contains(string(recorder.requests[0]), "offloaded") {
+		t.Errorf("期望发送卸载引用: %s", recorder.requests[0])
+	}
+	if data, err := os.ReadFile(dir + "/big.json"); err != nil || len(data) < 20000 {
+		t.Errorf("期望完整事件被写入卸载目录: %v", err)
+	}
+}
+
+func TestIngestSplitsOnPayloadTooLarge(t *testing.T) {
+	recorder := &ingestionRecorder{maxBytes: 1500}
+	server := newIngestionServer(t, recorder)
+	client := NewClient(server.URL, "pk", "sk")
+
+	var batch []IngestionEvent
+	for i := 0; i < 4; i++ {
+		batch = append(batch, createLargeEvent(fmt.Sprintf("event-%d", i), 600))
+	}
+
+	resp, err := client.Ingest(context.Background(), &IngestionRequest{Batch: batch})
+	if err != nil {
+		t.Fatalf("发送事件失败: %v", err)
+	}
+	if len(resp.Successes) != 4 || len(recorder.requests) < 2 {
+		t.Errorf("期望 413 后拆分请求, 实际为 %d 个请求, %d 个成功", len(recorder.requests), len(resp.Successes))
+	}
+}
+
+func TestIngestReturnsPartialResponse(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests > 1 {
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var ingestionReq IngestionRequest
+		_ = json.NewDecoder(req.Body).Decode(&ingestionReq)
+		resp := IngestionResponse{}
+		for _, event := range ingestionReq.Batch {
+			resp.Successes = append(resp.Successes, IngestionSuccess{ID: event.ID, Status: http.StatusCreated})
+		}
+		rw.WriteHeader(http.StatusMultiStatus)
+		_ = json.NewEncoder(rw).Encode(resp)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL, "pk", "sk", WithMaxBatchBytes(2000))
+
+	var batch []IngestionEvent
+	for i := 0; i < 5; i++ {
+		batch = append(batch, createLargeEvent(fmt.Sprintf("event-%d", i), 600))
+	}
+
+	resp, err := client.Ingest(context.Background(), &IngestionRequest{Batch: batch})
+	var partial *PartialIngestionError
+	if !errors.As(err, &partial) || resp == nil {
+		t.Fatalf("期望返回部分成功的响应和 PartialIngestionError, 实际为: %v", err)
+	}
+	if len(resp.Successes) == 0 || len(resp.Successes)+len(partial.Unsent) != len(batch) {
+		t.Errorf("期望成功 %d 个加未发送 %d 个等于 %d", len(resp.Successes), len(partial.Unsent), len(batch))
+	}
+	if partial.Unsent[0].ID != batch[len(resp.Successes)].ID {
+		t.Errorf("期望未发送的事件从 %s 开始, 实际为 %s", batch[len(resp.Successes)].ID, partial.Unsent[0].ID)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("期望 503 导致的部分失败可重试")
+	}
+}
+
+func TestIngestIsolatesEventTooLarge(t *testing.T) {
+	recorder := &ingestionRecorder{}
+	server := newIngestionServer(t, recorder)
+	client := NewClient(server.URL, "pk", "sk", WithMaxBatchBytes(4000))
+
+	// name 不属于可截断的字段，事件无法缩小到限制以内
+	tooLarge := *CreateSpanEvent("too-large", "2023-01-01T00:00:00Z", &ObservationBody{
+		ID:   "too-large",
+		Type: ObservationTypeSpan,
+		Name: strings.Repeat("x", 8000),
+	})
+	resp, err := client.Ingest(context.Background(), &IngestionRequest{Batch: []IngestionEvent{tooLarge, createLargeEvent("small", 10)}})
+	if err != nil {
+		t.Fatalf("期望其它事件正常发送, 实际为: %v", err)
+	}
+	if len(resp.Successes) != 1 || resp.Successes[0].ID != "small" {
+		t.Errorf("期望 small 发送成功, 实际为 %v", resp.Successes)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].ID != "too-large" || resp.Errors[0].Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("期望 too-large 以 413 被拒绝, 实际为 %v", resp.Errors)
+	}
+}
+
+func TestDirectoryOffloaderLimits(t *testing.T) {
+	dir := t.TempDir()
+	offloader := &DirectoryOffloader{Dir: dir, MaxBytes: 12000, Retention: 24 * time.Hour}
+	ctx := context.Background()
+	offload := func(id string, size int) {
+		if _, err := offloader.Offload(ctx, createLargeEvent(id, size)); err != nil {
+			t.Fatalf("卸载事件失败: %v", err)
+		}
+	}
+	exists := func(id string) bool {
+		_, err := os.Stat(dir + "/" + id + ".json")
+		return err == nil
+	}
+
+	offload("expired", 100)
+	offload("old", 5000)
+	now := time.Now()
+	_ = os.Chtimes(dir+"/expired.json", now.Add(-48*time.Hour), now.Add(-48*time.Hour))
+	_ = os.Chtimes(dir+"/old.json", now.Add(-time.Minute), now.Add(-time.Minute))
+
+	// 超过保留时间的文件被删除
+	offload("new", 100)
+	if exists("expired") || !exists("old") || !exists("new") {
+		t.Errorf("期望只删除过期的文件")
+	}
+
+	// 超过大小限制时删除最早的文件
+	offload("newer", 8000)
+	if exists("old") || !exists("new") || !exists("newer") {
+		t.Errorf("期望删除最早的文件以满足大小限制")
+	}
+}
+
+func TestIngestErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		retryable  bool
+		auth       bool
+		delay      time.Duration
+	}{
+		{name: "限流", status: http.StatusTooManyRequests, retryAfter: "7", retryable: true, delay: 7 * time.Second},
+		{name: "服务不可用", status: http.StatusServiceUnavailable, retryable: true},
+		{name: "请求无效", status: http.StatusBadRequest},
+		{name: "未授权", status: http.StatusUnauthorized, auth: true},
+		{name: "禁止访问", status: http.StatusForbidden, auth: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				http.Error(w, http.StatusText(tt.status), tt.status)
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, "pk", "sk")
+			_, err := client.Ingest(context.Background(), &IngestionRequest{Batch: []IngestionEvent{createLargeEvent("event-1", 10)}})
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+				t.Fatalf("期望状态码为 %d 的 APIError, 实际为: %v", tt.status, err)
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("期望可重试为 %t", tt.retryable)
+			}
+			if IsAuthError(err) != tt.auth {
+				t.Errorf("期望认证错误为 %t", tt.auth)
+			}
+			if RetryAfter(err) != tt.delay {
+				t.Errorf("期望 Retry-After 为 %s, 实际为 %s", tt.delay, RetryAfter(err))
+			}
+		})
+	}
+
+	t.Run("网络错误", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		client := NewClient(server.URL, "pk", "sk")
+		_, err := client.Ingest(context.Background(), &IngestionRequest{Batch: []IngestionEvent{createLargeEvent("event-1", 10)}})
+		if !IsRetryable(err) {
+			t.Errorf("期望网络错误可重试, 实际为: %v", err)
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"soon":                          0,
+	}
+	for value, expected := range tests {
+		if delay := ParseRetryAfter(value, now); delay != expected {
+			t.Errorf("ParseRetryAfter(%q) 期望 %s, 实际为 %s", value, expected, delay)
+		}
+	}
+}
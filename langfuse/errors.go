@@ -0,0 +1,135 @@
+package langfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIError is returned when the API answers with an unexpected status
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay asked by the Retry-After header, zero when absent
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+// Is makes a 413 response match ErrPayloadTooLarge
+func (e *APIError) Is(target error) bool {
+	return target == ErrPayloadTooLarge && e.StatusCode == http.StatusRequestEntityTooLarge
+}
+
+// Retryable tells whether the same request may succeed later:
+// rate limiting, request timeouts and server errors are retryable,
+// other client errors such as 400, 401 and 403 are permanent
+func (e *APIError) Retryable() bool {
+	return IsRetryableStatus(e.StatusCode)
+}
+
+// IsRetryableStatus tells whether a request or a single event that failed
+// with this status may succeed later
+func IsRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout ||
+		status >= http.StatusInternalServerError
+}
+
+// NetworkError is returned when the API could not be reached or the response could not be read
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// PartialIngestionError is returned by Ingest when a batch split into several
+// requests failed after some of them were sent. The response merges the
+// requests that were sent; Unsent lists the events that were not.
+type PartialIngestionError struct {
+	Unsent []IngestionEvent
+	Err    error
+}
+
+func (e *PartialIngestionError) Error() string {
+	return fmt.Sprintf("%d events were not sent: %v", len(e.Unsent), e.Err)
+}
+
+func (e *PartialIngestionError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable tells whether a failed request is worth sending again
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var networkErr *NetworkError
+	return errors.As(err, &networkErr)
+}
+
+// IsAuthError tells whether the API rejected the credentials
+func IsAuthError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// IsRateLimited tells whether the API answered 429 Too Many Requests
+func IsRateLimited(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+// RetryAfter returns the delay asked by the API before retrying, zero when none
+func RetryAfter(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// newAPIError builds the error of a response, reading its Retry-After header
+func newAPIError(resp *http.Response, body []byte, now time.Time) *APIError {
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), now),
+	}
+}
+
+// ParseRetryAfter parses a Retry-After value given either in seconds or as an HTTP date
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package log2fuse
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/peace0phmind/log2fuse/langfuse"
+)
+
+// LLMGeneration is the provider independent view of an LLM API call.
+type LLMGeneration struct {
+	Provider        string
+	Model           string
+	ModelParameters map[string]interface{}
+	Input           interface{}
+	Output          interface{}
+	Usage           *langfuse.Usage
+	UsageDetails    map[string]int
+	Metadata        map[string]interface{}
+	StatusMessage   string
+}
+
+// LLMParser recognises and parses the traffic of an LLM API.
+type LLMParser interface {
+	// parse returns nil when the record is not a call of this API.
+	parse(record *LogRecord, requestBody string, responseBody string) *LLMGeneration
+}
+
+func createLLMParsers() []LLMParser {
+	return []LLMParser{
+		&OpenAIChatParser{},
+		&AnthropicMessagesParser{},
+	}
+}
+
+func parseLLMGeneration(parsers []LLMParser, record *LogRecord, requestBody string, responseBody string) *LLMGeneration {
+	for _, parser := range parsers {
+		if generation := parser.parse(record, requestBody, responseBody); generation != nil {
+			return generation
+		}
+	}
+	return nil
+}
+
+func recordPath(record *LogRecord) string {
+	u, err := url.Parse(record.URL)
+	if err != nil {
+		return record.URL
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// copyModelParameters copies the request parameters that Langfuse accepts
+// as model parameters: strings, numbers, booleans and arrays of strings.
+// The other values would get the generation rejected and are left out.
+func copyModelParameters(request map[string]interface{}, keys []string) map[string]interface{} {
+	parameters := make(map[string]interface{})
+	for _, key := range keys {
+		if value, ok := request[key]; ok && isModelParameterValue(value) {
+			parameters[key] = value
+		}
+	}
+	if len(parameters) == 0 {
+		return nil
+	}
+	return parameters
+}
+
+func isModelParameterValue(value interface{}) bool {
+	switch v := value.(type) {
+	case string, float64, bool:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// copyRequestMetadata copies the request fields kept as generation metadata,
+// the object valued parameters such as tool_choice or response_format.
+func copyRequestMetadata(request map[string]interface{}, keys []string) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	for _, key := range keys {
+		if value, ok := request[key]; ok && value != nil {
+			metadata[key] = value
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+func jsonObject(value interface{}) map[string]interface{} {
+	object, _ := value.(map[string]interface{})
+	return object
+}
+
+func jsonArray(value interface{}) []interface{} {
+	array, _ := value.([]interface{})
+	return array
+}
+
+func jsonString(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
+
+func jsonInt(value interface{}) int {
+	number, _ := value.(float64)
+	return int(number)
+}
@@ -0,0 +1,248 @@
+package log2fuse
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/peace0phmind/log2fuse/langfuse"
+)
+
+var anthropicModelParameterKeys = []string{
+	"max_tokens",
+	"temperature",
+	"top_p",
+	"top_k",
+	"stop_sequences",
+	"stream",
+}
+
+// anthropicMetadataKeys are the object valued parameters, kept as metadata
+// since Langfuse only accepts scalar model parameters.
+var anthropicMetadataKeys = []string{
+	"tool_choice",
+}
+
+// AnthropicMessagesParser parses the native Anthropic /v1/messages API.
+//
+// The system prompt, content blocks, tool_use and tool_result blocks are
+// normalised to chat messages, so Langfuse renders them like any other chat.
+type AnthropicMessagesParser struct{}
+
+func (p *AnthropicMessagesParser) parse(record *LogRecord, requestBody string, responseBody string) *LLMGeneration {
+	if record.Method != http.MethodPost || !strings.HasSuffix(recordPath(record), "/messages") {
+		return nil
+	}
+
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(requestBody), &request); err != nil {
+		return nil
+	}
+	_, hasMessages := request["messages"]
+	_, hasMaxTokens := request["max_tokens"]
+	if !hasMessages || !hasMaxTokens {
+		return nil
+	}
+
+	messages := anthropicInputMessages(request["system"], jsonArray(request["messages"]))
+	generation := &LLMGeneration{
+		Provider:        "anthropic",
+		Model:           jsonString(request["model"]),
+		ModelParameters: anthropicModelParameters(request),
+		Input:           messages,
+		Metadata:        copyRequestMetadata(request, anthropicMetadataKeys),
+	}
+	if tools, ok := request["tools"]; ok {
+		generation.Input = map[string]interface{}{
+			"messages": messages,
+			"tools":    tools,
+		}
+	}
+
+	response := llmResponse(record, responseBody, reassembleAnthropicStream)
+	if response == nil {
+		if responseBody != "" {
+			generation.Output = responseBody
+		}
+		return generation
+	}
+
+	if apiError := jsonObject(response["error"]); apiError != nil {
+		generation.Output = apiError
+		generation.StatusMessage = jsonString(apiError["message"])
+		return generation
+	}
+
+	if model := jsonString(response["model"]); model != "" {
+		generation.Model = model
+	}
+	generation.Output = anthropicMessage("assistant", jsonArray(response["content"]))
+	generation.Usage, generation.UsageDetails = anthropicUsage(jsonObject(response["usage"]))
+	if generation.Metadata == nil {
+		generation.Metadata = make(map[string]interface{})
+	}
+	generation.Metadata["messageId"] = response["id"]
+	generation.Metadata["stopReason"] = response["stop_reason"]
+	generation.Metadata["stopSequence"] = response["stop_sequence"]
+
+	return generation
+}
+
+// anthropicModelParameters copies the scalar parameters and flattens the
+// extended thinking budget into thinking_budget_tokens.
+func anthropicModelParameters(request map[string]interface{}) map[string]interface{} {
+	parameters := copyModelParameters(request, anthropicModelParameterKeys)
+	thinking := jsonObject(request["thinking"])
+	if jsonString(thinking["type"]) != "enabled" {
+		return parameters
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+	parameters["thinking_budget_tokens"] = jsonInt(thinking["budget_tokens"])
+	return parameters
+}
+
+// anthropicInputMessages prepends the system prompt and flattens the
+// content blocks of every message.
+func anthropicInputMessages(system interface{}, messages []interface{}) []interface{} {
+	normalised := make([]interface{}, 0, len(messages)+1)
+
+	switch value := system.(type) {
+	case string:
+		normalised = append(normalised, map[string]interface{}{"role": "system", "content": value})
+	case []interface{}:
+		normalised = append(normalised, map[string]interface{}{"role": "system", "content": anthropicText(value)})
+	}
+
+	for _, message := range messages {
+		object := jsonObject(message)
+		role := jsonString(object["role"])
+		switch content := object["content"].(type) {
+		case string:
+			normalised = append(normalised, map[string]interface{}{"role": role, "content": content})
+		case []interface{}:
+			// tool_result blocks become tool messages following the message
+			for _, block := range content {
+				if result := jsonObject(block); jsonString(result["type"]) == "tool_result" {
+					normalised = append(normalised, anthropicToolResult(result))
+				}
+			}
+			if message := anthropicMessage(role, content); message != nil {
+				normalised = append(normalised, message)
+			}
+		}
+	}
+
+	return normalised
+}
+
+// anthropicMessage converts content blocks to a chat message with tool_calls.
+// Returns nil when the blocks only contained tool results.
+func anthropicMessage(role string, blocks []interface{}) map[string]interface{} {
+	var texts []string
+	var thinking []string
+	var toolCalls []interface{}
+	var parts []interface{}
+
+	for _, item := range blocks {
+		block := jsonObject(item)
+		switch jsonString(block["type"]) {
+		case "text":
+			texts = append(texts, jsonString(block["text"]))
+		case "thinking":
+			thinking = append(thinking, jsonString(block["thinking"]))
+		case "tool_use":
+			arguments, _ := json.Marshal(block["input"])
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":   block["id"],
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      block["name"],
+					"arguments": string(arguments),
+				},
+			})
+		case "tool_result":
+		default:
+			// images, documents and other blocks are kept as they are
+			parts = append(parts, block)
+		}
+	}
+
+	if len(texts) == 0 && len(thinking) == 0 && len(toolCalls) == 0 && len(parts) == 0 {
+		return nil
+	}
+
+	message := map[string]interface{}{"role": role}
+	if len(parts) > 0 {
+		for _, text := range texts {
+			parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+		}
+		message["content"] = parts
+	} else {
+		message["content"] = strings.Join(texts, "")
+	}
+	if len(thinking) > 0 {
+		message["thinking"] = strings.Join(thinking, "")
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+	return message
+}
+
+func anthropicToolResult(block map[string]interface{}) map[string]interface{} {
+	message := map[string]interface{}{
+		"role":         "tool",
+		"tool_call_id": block["tool_use_id"],
+	}
+	switch content := block["content"].(type) {
+	case []interface{}:
+		message["content"] = anthropicText(content)
+	default:
+		message["content"] = content
+	}
+	if isError, ok := block["is_error"].(bool); ok && isError {
+		message["is_error"] = true
+	}
+	return message
+}
+
+func anthropicText(blocks []interface{}) string {
+	var texts []string
+	for _, item := range blocks {
+		block := jsonObject(item)
+		if jsonString(block["type"]) == "text" {
+			texts = append(texts, jsonString(block["text"]))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// anthropicUsage reports the cache tokens next to input: the Anthropic
+// input_tokens do not include them, so the total adds them once.
+func anthropicUsage(usage map[string]interface{}) (*langfuse.Usage, map[string]int) {
+	if usage == nil {
+		return nil, nil
+	}
+
+	input := jsonInt(usage["input_tokens"])
+	output := jsonInt(usage["output_tokens"])
+	cacheRead := jsonInt(usage["cache_read_input_tokens"])
+	cacheCreation := jsonInt(usage["cache_creation_input_tokens"])
+	total := input + output + cacheRead + cacheCreation
+
+	details := map[string]int{
+		"input":  input,
+		"output": output,
+		"total":  total,
+	}
+	if cacheRead > 0 {
+		details["cache_read_input_tokens"] = cacheRead
+	}
+	if cacheCreation > 0 {
+		details["cache_creation_input_tokens"] = cacheCreation
+	}
+
+	return &langfuse.Usage{Input: input, Output: output, Total: total, Unit: "TOKENS"}, details
+}
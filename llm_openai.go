@@ -0,0 +1,140 @@
+package log2fuse
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/peace0phmind/log2fuse/langfuse"
+)
+
+var openAIModelParameterKeys = []string{
+	"temperature",
+	"max_tokens",
+	"max_completion_tokens",
+	"top_p",
+	"frequency_penalty",
+	"presence_penalty",
+	"n",
+	"stop",
+	"seed",
+	"stream",
+	"parallel_tool_calls",
+	"reasoning_effort",
+	"logprobs",
+	"top_logprobs",
+}
+
+// openAIMetadataKeys are the object valued parameters, kept as metadata
+// since Langfuse only accepts scalar model parameters.
+var openAIMetadataKeys = []string{
+	"response_format",
+	"tool_choice",
+	"logit_bias",
+}
+
+// OpenAIChatParser parses the OpenAI compatible /v1/chat/completions API.
+type OpenAIChatParser struct{}
+
+func (p *OpenAIChatParser) parse(record *LogRecord, requestBody string, responseBody string) *LLMGeneration {
+	if record.Method != http.MethodPost || !strings.HasSuffix(recordPath(record), "/chat/completions") {
+		return nil
+	}
+
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(requestBody), &request); err != nil {
+		return nil
+	}
+	messages, hasMessages := request["messages"]
+	if !hasMessages {
+		return nil
+	}
+
+	generation := &LLMGeneration{
+		Provider:        "openai",
+		Model:           jsonString(request["model"]),
+		ModelParameters: copyModelParameters(request, openAIModelParameterKeys),
+		Input:           messages,
+		Metadata:        copyRequestMetadata(request, openAIMetadataKeys),
+	}
+	if tools, ok := request["tools"]; ok {
+		generation.Input = map[string]interface{}{
+			"messages": messages,
+			"tools":    tools,
+		}
+	}
+
+	response := llmResponse(record, responseBody, reassembleOpenAIStream)
+	if response == nil {
+		if responseBody != "" {
+			generation.Output = responseBody
+		}
+		return generation
+	}
+
+	if apiError := jsonObject(response["error"]); apiError != nil {
+		generation.Output = apiError
+		generation.StatusMessage = jsonString(apiError["message"])
+		return generation
+	}
+
+	if model := jsonString(response["model"]); model != "" {
+		generation.Model = model
+	}
+	generation.Output = openAIChoicesOutput(jsonArray(response["choices"]))
+	generation.Usage, generation.UsageDetails = openAIUsage(jsonObject(response["usage"]))
+
+	return generation
+}
+
+// openAIChoicesOutput returns the assistant message, or all of them when n > 1.
+func openAIChoicesOutput(choices []interface{}) interface{} {
+	messages := make([]interface{}, 0, len(choices))
+	for _, choice := range choices {
+		if message, ok := jsonObject(choice)["message"]; ok {
+			messages = append(messages, message)
+		}
+	}
+	switch len(messages) {
+	case 0:
+		return nil
+	case 1:
+		return messages[0]
+	default:
+		return messages
+	}
+}
+
+// openAIUsage splits the cached prompt tokens out of input and the reasoning
+// tokens out of output: Langfuse sums the usage details for the cost, and the
+// OpenAI counts already include them.
+func openAIUsage(usage map[string]interface{}) (*langfuse.Usage, map[string]int) {
+	if usage == nil {
+		return nil, nil
+	}
+
+	input := jsonInt(usage["prompt_tokens"])
+	output := jsonInt(usage["completion_tokens"])
+	total := jsonInt(usage["total_tokens"])
+	if total == 0 {
+		total = input + output
+	}
+	cached := jsonInt(jsonObject(usage["prompt_tokens_details"])["cached_tokens"])
+	reasoning := jsonInt(jsonObject(usage["completion_tokens_details"])["reasoning_tokens"])
+	input -= cached
+	output -= reasoning
+
+	details := map[string]int{
+		"input":  input,
+		"output": output,
+		"total":  total,
+	}
+	if cached > 0 {
+		details["input_cached_tokens"] = cached
+	}
+	if reasoning > 0 {
+		details["output_reasoning_tokens"] = reasoning
+	}
+
+	return &langfuse.Usage{Input: input, Output: output, Total: total, Unit: "TOKENS"}, details
+}
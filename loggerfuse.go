@@ -3,34 +3,139 @@ package log2fuse
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/peace0phmind/log2fuse/langfuse"
 )
 
+const (
+	defaultBatchMaxEvents      = 100
+	defaultBatchMaxBytes       = 3 * 1024 * 1024 // langfuse 限制单批 3.5MB
+	defaultBatchFlushInterval  = time.Second
+	defaultHealthProbeInterval = 10 * time.Second
+	defaultShutdownTimeout     = 5 * time.Second
+	// maxBatchAttempts bounds the sends of a batch without spool
+	maxBatchAttempts = 3
+	// maxRetryBatches bounds the batches waiting for the backoff without spool
+	maxRetryBatches = 10
+)
+
+// LangfuseLoggerOptions configures how the LangfuseLogger batches events.
+// Zero values fall back to the defaults.
+type LangfuseLoggerOptions struct {
+	// BatchMaxEvents is the maximum number of events sent in one ingestion request.
+	BatchMaxEvents int
+	// BatchMaxBytes is the maximum serialized size of the events of one ingestion request.
+	BatchMaxBytes int
+	// BatchFlushInterval is the maximum time an event waits before being sent.
+	BatchFlushInterval time.Duration
+	// HealthProbeInterval is the interval of the health checks while langfuse is unreachable.
+	HealthProbeInterval time.Duration
+	// Spool keeps the events on disk while langfuse is unreachable. Optional.
+	Spool *Spool
+	// ShutdownTimeout bounds the time Close waits for the queued records to be sent.
+	ShutdownTimeout time.Duration
+}
+
+func (o LangfuseLoggerOptions) withDefaults() LangfuseLoggerOptions {
+	if o.BatchMaxEvents <= 0 {
+		o.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if o.BatchMaxBytes <= 0 {
+		o.BatchMaxBytes = defaultBatchMaxBytes
+	}
+	if o.BatchFlushInterval <= 0 {
+		o.BatchFlushInterval = defaultBatchFlushInterval
+	}
+	if o.HealthProbeInterval <= 0 {
+		o.HealthProbeInterval = defaultHealthProbeInterval
+	}
+	if o.ShutdownTimeout <= 0 {
+		o.ShutdownTimeout = defaultShutdownTimeout
+	}
+	return o
+}
+
+// ingestionBatch accumulates events until one of the flush limits is reached.
+type ingestionBatch struct {
+	events  []langfuse.IngestionEvent
+	size    int
+	records int
+	system  string
+}
+
+func (b *ingestionBatch) add(event langfuse.IngestionEvent, size int) {
+	b.events = append(b.events, event)
+	b.size += size
+}
+
+func (b *ingestionBatch) reset() {
+	b.events = nil
+	b.size = 0
+	b.records = 0
+}
+
+// retryBatch is a failed batch waiting for the backoff to be sent again
+type retryBatch struct {
+	events   []langfuse.IngestionEvent
+	records  int
+	system   string
+	attempts int
+}
+
+// recordStats counts what happened to the records.
+type recordStats struct {
+	sent    int
+	spooled int
+	lost    int
+}
+
 // LangfuseLogger a langfuse logger implementation.
 type LangfuseLogger struct {
 	clock         LoggerClock
 	uuidGenerator UUIDGenerator
 	logger        *log.Logger
 	client        *langfuse.Client
+	options       LangfuseLoggerOptions
+	llmParsers    []LLMParser
 	chain         chan *LogRecord
+	retries       []*retryBatch // 只由处理 goroutine 访问
+	overflow      chan *LogRecord
+	recovered     chan struct{}
 	ctx           context.Context
 	cancel        context.CancelFunc
 
+	// 关闭管理，closeMutex 保证关闭后不再有记录进入 chain
+	closeMutex   sync.RWMutex
+	closed       bool
+	shutdown     chan struct{}
+	drained      chan struct{}
+	shutdownOnce sync.Once
+	statsMutex   sync.Mutex
+	stats        recordStats
+
+	// chain 已满或已关闭时，记录交给 spooler 写入磁盘
+	overflowMutex   sync.RWMutex
+	overflowStopped bool
+
 	// 健康状态管理
 	healthMutex sync.RWMutex
 	isHealthy   bool
 	lastError   time.Time
 	probeMode   bool
+	backoff     backoff
 }
 
 // NewLangfuseLogger creates a new LangfuseLogger instance
-func NewLangfuseLogger(clock LoggerClock, uuidGenerator UUIDGenerator, logger *log.Logger, client *langfuse.Client) *LangfuseLogger {
+func NewLangfuseLogger(clock LoggerClock, uuidGenerator UUIDGenerator, logger *log.Logger, client *langfuse.Client, options LangfuseLoggerOptions) *LangfuseLogger {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	jhl := &LangfuseLogger{
@@ -38,14 +143,24 @@ func NewLangfuseLogger(clock LoggerClock, uuidGenerator UUIDGenerator, logger *l
 		uuidGenerator: uuidGenerator,
 		logger:        logger,
 		client:        client,
+		options:       options.withDefaults(),
+		llmParsers:    createLLMParsers(),
 		chain:         make(chan *LogRecord, 1000), // 设置chain大小为1000
+		overflow:      make(chan *LogRecord, 1000),
+		recovered:     make(chan struct{}, 1),
+		shutdown:      make(chan struct{}),
+		drained:       make(chan struct{}),
 		ctx:           ctx,
 		cancel:        cancel,
 		isHealthy:     true, // 初始状态假设为健康
+		backoff:       backoff{clock: clock},
 	}
 
 	// 启动后台处理goroutine
 	jhl.startProcessor()
+	if jhl.options.Spool != nil {
+		go jhl.processOverflow()
+	}
 
 	// 启动健康探测
 	jhl.StartHealthProbe()
@@ -55,22 +170,89 @@ func NewLangfuseLogger(clock LoggerClock, uuidGenerator UUIDGenerator, logger *l
 
 // Print logs the record to langfuse and local logger
 func (jhl *LangfuseLogger) Print(record *LogRecord) {
+	jhl.closeMutex.RLock()
+	defer jhl.closeMutex.RUnlock()
+
+	// 已关闭时不再进入chain
+	if jhl.closed {
+		if jhl.options.Spool != nil {
+			jhl.spoolRecord(record)
+			return
+		}
+		jhl.countRecords(recordStats{lost: 1})
+		jhl.logger.Printf("Dropping record, the langfuse logger is shut down")
+		return
+	}
+
 	// 直接将记录加入chain，不进行阻塞
 	select {
 	case jhl.chain <- record:
 		// 成功加入chain
 	default:
-		// chain已满，移除最早的消息并加入新消息
+		// chain已满，有 spool 时写入磁盘
+		if jhl.options.Spool != nil {
+			jhl.spoolRecord(record)
+			return
+		}
+		// 否则移除最早的消息并加入新消息
 		select {
 		case <-jhl.chain: // 移除最早的消息
-			jhl.chain <- record // 加入新消息
+			jhl.countRecords(recordStats{lost: 1})
+		default:
+		}
+		select {
+		case jhl.chain <- record: // 加入新消息
 		default:
-			// 如果还是失败，记录错误
+			// 空位已被其它请求占用，丢弃新消息
+			jhl.countRecords(recordStats{lost: 1})
 			jhl.logger.Printf("Failed to add record to chain, chain is full")
 		}
 	}
 }
 
+// spoolRecord hands a record over to the spooler, so that its events are
+// created and written to disk off the request path
+func (jhl *LangfuseLogger) spoolRecord(record *LogRecord) {
+	jhl.overflowMutex.RLock()
+	defer jhl.overflowMutex.RUnlock()
+
+	if jhl.overflowStopped {
+		jhl.countRecords(recordStats{lost: 1})
+		jhl.logger.Printf("Dropping record, the langfuse logger is stopped")
+		return
+	}
+	select {
+	case jhl.overflow <- record:
+	default:
+		jhl.countRecords(recordStats{lost: 1})
+		jhl.logger.Printf("Dropping record, the spool queue is full")
+	}
+}
+
+// processOverflow spools the records handed over by spoolRecord until the
+// logger is stopped, then spools the records left in the queue
+func (jhl *LangfuseLogger) processOverflow() {
+	for {
+		select {
+		case record := <-jhl.overflow:
+			jhl.spoolRecords(1, jhl.createEvents(record))
+		case <-jhl.ctx.Done():
+			jhl.overflowMutex.Lock()
+			jhl.overflowStopped = true
+			jhl.overflowMutex.Unlock()
+
+			for {
+				select {
+				case record := <-jhl.overflow:
+					jhl.spoolRecords(1, jhl.createEvents(record))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
 // startProcessor starts the background processor for handling chain records
 func (jhl *LangfuseLogger) startProcessor() {
 	go func() {
@@ -78,57 +260,363 @@ func (jhl *LangfuseLogger) startProcessor() {
 	}()
 }
 
-// processChain processes records from the chain
+// processChain turns records from the chain into events and sends them in
+// batches, when the batch is full or when the flush interval elapsed
 func (jhl *LangfuseLogger) processChain() {
+	defer close(jhl.drained)
+
+	ticker := time.NewTicker(jhl.options.BatchFlushInterval)
+	defer ticker.Stop()
+
+	batch := &ingestionBatch{}
 	for {
 		select {
 		case record := <-jhl.chain:
-			jhl.processRecord(record)
+			jhl.addRecord(batch, record)
+		case <-jhl.shutdown:
+			jhl.drain(batch)
+			return
+		case <-ticker.C:
+			jhl.processRetries()
+			if len(batch.events) > 0 {
+				jhl.processBatch(batch)
+			} else if jhl.options.Spool != nil && !jhl.isInProbeMode() {
+				jhl.replaySpool()
+			}
+		case <-jhl.recovered:
+			jhl.replaySpool()
 		case <-jhl.ctx.Done():
+			// 关闭超时，剩余的记录写入 spool 或计为丢失
+			jhl.drain(batch)
 			return
 		}
 	}
 }
 
-// processRecord processes a single record with retry mechanism
-func (jhl *LangfuseLogger) processRecord(record *LogRecord) {
-	maxRetries := 3
-	retryDelay := time.Second
+// addRecord adds the events of a record to the batch. The batch is sent
+// first when the events would not fit in it, so a record is never split.
+func (jhl *LangfuseLogger) addRecord(batch *ingestionBatch, record *LogRecord) {
+	events := jhl.createEvents(record)
+	sizes := make([]int, len(events))
+	recordSize := 0
+	for i, event := range events {
+		sizes[i] = eventSize(event)
+		recordSize += sizes[i]
+	}
+
+	if batch.records > 0 && (batch.size+recordSize > jhl.options.BatchMaxBytes || len(batch.events)+len(events) > jhl.options.BatchMaxEvents) {
+		jhl.processBatch(batch)
+	}
+
+	batch.system = record.System
+	batch.records++
+	for i, event := range events {
+		batch.add(event, sizes[i])
+	}
+	if len(batch.events) >= jhl.options.BatchMaxEvents {
+		jhl.processBatch(batch)
+	}
+}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		// 检查是否已取消
+// drain sends the records left in the chain, the last batch and the batches
+// waiting for the backoff. It gives up when the logger is stopped, spooling
+// what is left when there is a spool and counting it as lost otherwise.
+func (jhl *LangfuseLogger) drain(batch *ingestionBatch) {
+	for {
 		select {
 		case <-jhl.ctx.Done():
+			jhl.abandonBatch(batch.records, batch.events)
+			batch.reset()
+			jhl.abandonChain()
+			jhl.abandonRetries()
+			return
+		default:
+		}
+
+		select {
+		case record := <-jhl.chain:
+			jhl.addRecord(batch, record)
+			continue
+		default:
+		}
+		if batch.records > 0 {
+			jhl.processBatch(batch)
+		}
+		if len(jhl.retries) == 0 {
 			return
+		}
+		// 关闭时等待退避结束再重试，超时由 ctx 控制
+		if err := jhl.backoff.wait(jhl.ctx); err == nil {
+			jhl.processRetries()
+		}
+	}
+}
+
+// abandonBatch spools the events the stopped logger could not send, or counts their records as lost
+func (jhl *LangfuseLogger) abandonBatch(records int, events []langfuse.IngestionEvent) {
+	if jhl.options.Spool != nil {
+		jhl.spoolRecords(records, events)
+		return
+	}
+	jhl.countRecords(recordStats{lost: records})
+}
+
+// abandonChain spools the records left in the chain by the stopped logger, or counts them as lost
+func (jhl *LangfuseLogger) abandonChain() {
+	if jhl.options.Spool == nil {
+		jhl.countRecords(recordStats{lost: len(jhl.chain)})
+		return
+	}
+	for {
+		select {
+		case record := <-jhl.chain:
+			jhl.spoolRecords(1, jhl.createEvents(record))
 		default:
+			return
 		}
+	}
+}
 
-		// 尝试发送记录
-		if err := jhl.sendRecord(record); err != nil {
-			jhl.logger.Printf("Failed to send record (attempt %d/%d): %v", attempt+1, maxRetries, err)
+// abandonRetries counts the records of the batches waiting for the backoff as lost
+func (jhl *LangfuseLogger) abandonRetries() {
+	for _, retry := range jhl.retries {
+		jhl.abandonBatch(retry.records, retry.events)
+	}
+	jhl.retries = nil
+}
 
-			// 标记为不健康状态，进入探测模式
-			jhl.markUnhealthy()
+// countRecords adds to the record statistics
+func (jhl *LangfuseLogger) countRecords(stats recordStats) {
+	jhl.statsMutex.Lock()
+	defer jhl.statsMutex.Unlock()
 
-			if attempt < maxRetries-1 {
-				select {
-				case <-time.After(retryDelay):
-				case <-jhl.ctx.Done():
-					return
-				}
-				retryDelay *= 2
-				continue
-			}
-			// 最后一次尝试失败，记录错误
-			jhl.logger.Printf("Failed to send record after %d attempts: %v", maxRetries, err)
-		} else {
-			// 发送成功，标记为健康状态
-			jhl.markHealthy()
+	jhl.stats.sent += stats.sent
+	jhl.stats.spooled += stats.spooled
+	jhl.stats.lost += stats.lost
+}
+
+func (jhl *LangfuseLogger) recordStats() recordStats {
+	jhl.statsMutex.Lock()
+	defer jhl.statsMutex.Unlock()
+
+	return jhl.stats
+}
+
+// eventSize returns the serialized size of an event
+func eventSize(event langfuse.IngestionEvent) int {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// processBatch sends the batch, then resets it. Without spool a failed batch
+// is queued until the shared backoff has elapsed, so that the processor keeps
+// taking records from the chain meanwhile; permanent errors are not retried.
+func (jhl *LangfuseLogger) processBatch(batch *ingestionBatch) {
+	defer batch.reset()
+
+	if jhl.options.Spool != nil {
+		jhl.processBatchWithSpool(batch)
+		return
+	}
+
+	jhl.queueRetry(&retryBatch{events: batch.events, records: batch.records, system: batch.system})
+	jhl.processRetries()
+}
+
+// queueRetry queues a batch after the ones already waiting, dropping the
+// oldest one when too many batches wait
+func (jhl *LangfuseLogger) queueRetry(retry *retryBatch) {
+	if len(jhl.retries) >= maxRetryBatches {
+		oldest := jhl.retries[0]
+		jhl.retries = jhl.retries[1:]
+		jhl.logger.Printf("Dropping %d events waiting for the backoff, too many batches are waiting", len(oldest.events))
+		jhl.countRecords(recordStats{lost: oldest.records})
+	}
+	jhl.retries = append(jhl.retries, retry)
+}
+
+// processRetries sends the queued batches in order while the backoff allows it
+func (jhl *LangfuseLogger) processRetries() {
+	for len(jhl.retries) > 0 && !jhl.backoff.active() {
+		retry := jhl.retries[0]
+		jhl.retries = jhl.retries[1:]
+		if !jhl.attemptBatch(retry) {
 			return
 		}
 	}
 }
 
+// attemptBatch sends a queued batch once. A retryable failure puts it back
+// at the head of the queue until it has been attempted maxBatchAttempts times.
+// Returns false when the batch was put back.
+func (jhl *LangfuseLogger) attemptBatch(retry *retryBatch) bool {
+	retry.attempts++
+	batch := &ingestionBatch{events: retry.events, records: retry.records, system: retry.system}
+	err := jhl.sendBatch(batch)
+	if err == nil {
+		// 发送成功，标记为健康状态
+		jhl.countRecords(recordStats{sent: retry.records})
+		jhl.markSent()
+		return true
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// 关闭时中断了发送，不是 langfuse 拒绝了事件
+		jhl.abandonBatch(retry.records, retry.events)
+		return true
+	}
+	if !isRetryable(err) {
+		jhl.reportPermanentError(batch, err)
+		return true
+	}
+
+	// 只重试失败的事件
+	retry.events = retryEvents(batch, err)
+	delay := jhl.markFailed(err)
+	if retry.attempts >= maxBatchAttempts {
+		// 最后一次尝试失败，记录错误
+		jhl.logger.Printf("Failed to send %d events after %d attempts: %v", len(retry.events), maxBatchAttempts, err)
+		jhl.countRecords(recordStats{lost: retry.records})
+		return true
+	}
+	jhl.logger.Printf("Failed to send %d events (attempt %d/%d), retrying in %s: %v", len(retry.events), retry.attempts, maxBatchAttempts, delay, err)
+	jhl.retries = append([]*retryBatch{retry}, jhl.retries...)
+	return false
+}
+
+// processBatchWithSpool sends the batch once, or spools it while langfuse is
+// unreachable. Spooled events are replayed first so that the order is kept.
+func (jhl *LangfuseLogger) processBatchWithSpool(batch *ingestionBatch) {
+	if !jhl.isInProbeMode() && !jhl.backoff.active() {
+		jhl.replaySpool()
+	}
+	if jhl.isInProbeMode() || jhl.backoff.active() || jhl.options.Spool.Pending() {
+		jhl.spoolRecords(batch.records, batch.events)
+		return
+	}
+
+	err := jhl.sendBatch(batch)
+	if err == nil {
+		jhl.countRecords(recordStats{sent: batch.records})
+		jhl.markSent()
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		jhl.abandonBatch(batch.records, batch.events)
+		return
+	}
+	if !isRetryable(err) {
+		jhl.reportPermanentError(batch, err)
+		return
+	}
+
+	events := retryEvents(batch, err)
+	delay := jhl.markFailed(err)
+	jhl.logger.Printf("Failed to send %d events, spooling them and backing off for %s: %v", len(events), delay, err)
+	jhl.spoolRecords(batch.records, events)
+}
+
+// spoolRecords writes the events of the records to the spool
+func (jhl *LangfuseLogger) spoolRecords(records int, events []langfuse.IngestionEvent) {
+	if err := jhl.options.Spool.Write(events); err != nil {
+		jhl.logger.Printf("Failed to spool %d events, they are lost: %v", len(events), err)
+		jhl.countRecords(recordStats{lost: records})
+		return
+	}
+	jhl.countRecords(recordStats{spooled: records})
+}
+
+// replaySpool sends the spooled events in order
+func (jhl *LangfuseLogger) replaySpool() {
+	if jhl.backoff.active() || !jhl.options.Spool.Pending() {
+		return
+	}
+
+	// 部分失败的事件在重放结束后重新写入 spool
+	var failed []langfuse.IngestionEvent
+	replayed, err := jhl.options.Spool.Replay(func(events []langfuse.IngestionEvent) error {
+		batch := &ingestionBatch{events: events}
+		err := jhl.sendBatch(batch)
+		var partial *partialIngestionError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &partial):
+			// 部分失败，该段视为已发送，只保留失败的事件
+			failed = append(failed, partial.events...)
+			return nil
+		case errors.Is(err, context.Canceled):
+			// 关闭时中断了重放，该段留在 spool 中
+			return err
+		case !isRetryable(err):
+			// 永久错误，重放也不会成功，丢弃该段
+			jhl.reportPermanentError(batch, err)
+			return nil
+		default:
+			return err
+		}
+	})
+	if errors.Is(err, errSpoolLocked) || errors.Is(err, context.Canceled) {
+		// 其它实例正在重放或已关闭，不影响健康状态
+		return
+	}
+	if len(failed) > 0 {
+		jhl.logger.Printf("Failed to replay %d spooled events, spooling them again", len(failed))
+		jhl.spoolRecords(0, failed)
+		if err == nil {
+			err = &partialIngestionError{events: failed}
+		}
+	}
+	if replayed > 0 {
+		jhl.logger.Printf("Replayed %d spooled events", replayed)
+	}
+	if err != nil {
+		delay := jhl.markFailed(err)
+		jhl.logger.Printf("Failed to replay spool, backing off for %s: %v", delay, err)
+	} else {
+		jhl.markSent()
+	}
+}
+
+// errUnhealthy is returned while the client waits for langfuse to recover
+var errUnhealthy = errors.New("client is unhealthy and in probe mode")
+
+// isRetryable tells whether a failed batch may be sent again
+func isRetryable(err error) bool {
+	var partial *partialIngestionError
+	return errors.Is(err, errUnhealthy) || errors.As(err, &partial) || langfuse.IsRetryable(err)
+}
+
+// markFailed extends the shared backoff after a retryable failure and returns
+// the delay. Langfuse is only considered down when the whole request failed
+// and it did not rate limit us.
+func (jhl *LangfuseLogger) markFailed(err error) time.Duration {
+	var partial *partialIngestionError
+	if !langfuse.IsRateLimited(err) && !errors.Is(err, errUnhealthy) && !errors.As(err, &partial) {
+		jhl.markUnhealthy()
+	}
+	return jhl.backoff.fail(langfuse.RetryAfter(err))
+}
+
+// markSent resets the backoff and the health state after a successful request
+func (jhl *LangfuseLogger) markSent() {
+	jhl.backoff.succeed()
+	jhl.markHealthy()
+}
+
+// reportPermanentError drops a batch rejected for a reason retrying cannot fix
+func (jhl *LangfuseLogger) reportPermanentError(batch *ingestionBatch, err error) {
+	jhl.countRecords(recordStats{lost: batch.records})
+	if langfuse.IsAuthError(err) {
+		jhl.logger.Printf("Langfuse rejected the credentials, dropping %d events without retrying, check the langfuse public and secret keys: %v", len(batch.events), err)
+		return
+	}
+	jhl.logger.Printf("Langfuse rejected %d events, dropping them without retrying: %v", len(batch.events), err)
+}
+
 // markUnhealthy marks the client as unhealthy and enters probe mode
 func (jhl *LangfuseLogger) markUnhealthy() {
 	jhl.healthMutex.Lock()
@@ -152,25 +640,26 @@ func (jhl *LangfuseLogger) markHealthy() {
 // This method is now only called when in probe mode or when explicitly needed
 func (jhl *LangfuseLogger) isClientHealthy() bool {
 	jhl.healthMutex.RLock()
-	defer jhl.healthMutex.RUnlock()
+	isHealthy, probeMode, lastError := jhl.isHealthy, jhl.probeMode, jhl.lastError
+	jhl.healthMutex.RUnlock()
 
 	// 如果当前状态是健康的，直接返回true
-	if jhl.isHealthy && !jhl.probeMode {
+	if isHealthy && !probeMode {
 		return true
 	}
 
 	// 在探测模式下，进行实际的健康检查
-	if jhl.probeMode {
+	if probeMode {
 		// 检查距离上次错误是否已经过了足够的时间（避免频繁检查）
-		if time.Since(jhl.lastError) < 5*time.Second {
+		if jhl.clock.Now().Sub(lastError) < jhl.options.HealthProbeInterval/2 {
 			return false
 		}
 
-		// 执行实际的健康检查
+		// 执行实际的健康检查，网络请求期间不持有锁
 		return jhl.performHealthCheck()
 	}
 
-	return jhl.isHealthy
+	return isHealthy
 }
 
 // performHealthCheck performs the actual health check against langfuse
@@ -192,24 +681,143 @@ func (jhl *LangfuseLogger) performHealthCheck() bool {
 	return isHealthy
 }
 
-// sendRecord sends a single record to langfuse
-func (jhl *LangfuseLogger) sendRecord(record *LogRecord) error {
+// sendBatch sends a batch of events to langfuse
+func (jhl *LangfuseLogger) sendBatch(batch *ingestionBatch) error {
 	// 在探测模式下，发送前检查健康状态
 	if jhl.isInProbeMode() {
 		if !jhl.isClientHealthy() {
-			return fmt.Errorf("client is unhealthy and in probe mode")
+			return errUnhealthy
 		}
 		// 健康检查通过，退出探测模式
 		jhl.markHealthy()
 	}
 
-	requestBodyText, _ := record.RequestBodyDecoder.decode(record.RequestBody)
-	responseBodyText, _ := record.ResponseBodyDecoder.decode(record.ResponseBody)
+	ingestionReq := &langfuse.IngestionRequest{
+		Batch: batch.events,
+		Metadata: map[string]interface{}{
+			"source": "log2fuse",
+			"system": batch.system,
+		},
+	}
+
+	// 发送到 langfuse
+	resp, err := jhl.client.Ingest(jhl.ctx, ingestionReq)
+	var unsent *langfuse.PartialIngestionError
+	if errors.As(err, &unsent) {
+		// 拆分后的部分请求已发送，只重试未发送的事件
+		jhl.logger.Printf("Failed to send %d of %d events to langfuse: %v", len(unsent.Unsent), len(batch.events), unsent.Err)
+	} else if err != nil {
+		return fmt.Errorf("failed to send to langfuse: %w", err)
+	}
+
+	// 记录发送结果，部分失败逐个事件处理
+	if len(resp.Successes) > 0 {
+		jhl.logger.Printf("Successfully sent %d events to langfuse", len(resp.Successes))
+	}
+	if len(resp.Errors) == 0 && unsent == nil {
+		return nil
+	}
+
+	events := make(map[string]langfuse.IngestionEvent, len(batch.events))
+	for _, event := range batch.events {
+		events[event.ID] = event
+	}
+
+	var failed []langfuse.IngestionEvent
+	var rejected []langfuse.IngestionError
+	for _, ingestionError := range resp.Errors {
+		event, ok := events[ingestionError.ID]
+		if ok && langfuse.IsRetryableStatus(ingestionError.Status) {
+			failed = append(failed, event)
+			continue
+		}
+		rejected = append(rejected, ingestionError)
+	}
+	jhl.reportRejectedEvents(len(batch.events), events, rejected)
+
+	if unsent != nil {
+		if isRetryable(unsent.Err) || errors.Is(unsent.Err, context.Canceled) {
+			failed = append(failed, unsent.Unsent...)
+		} else {
+			jhl.logger.Printf("Langfuse rejected %d events, dropping them without retrying: %v", len(unsent.Unsent), unsent.Err)
+		}
+	}
+	if len(failed) > 0 {
+		return &partialIngestionError{events: failed}
+	}
+	return nil
+}
+
+// maxReportedEventBytes bounds the body of the sample event logged for a batch
+const maxReportedEventBytes = 1024
+
+// reportRejectedEvents logs the events of a batch langfuse rejected as invalid,
+// since sending them again cannot succeed. A single line gives the count per
+// status and the first event as a sample, with its body truncated.
+func (jhl *LangfuseLogger) reportRejectedEvents(total int, events map[string]langfuse.IngestionEvent, rejected []langfuse.IngestionError) {
+	if len(rejected) == 0 {
+		return
+	}
+
+	counts := make(map[int]int)
+	for _, ingestionError := range rejected {
+		counts[ingestionError.Status]++
+	}
+	statuses := make([]int, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	summary := make([]string, len(statuses))
+	for i, status := range statuses {
+		summary[i] = fmt.Sprintf("%d x%d", status, counts[status])
+	}
+
+	sample := rejected[0]
+	event, ok := events[sample.ID]
+	body := []byte("unknown event")
+	if ok {
+		var err error
+		if body, err = json.Marshal(event.Body); err != nil {
+			body = []byte(err.Error())
+		}
+	}
+	if len(body) > maxReportedEventBytes {
+		body = append(body[:maxReportedEventBytes:maxReportedEventBytes], fmt.Sprintf("...[truncated %d bytes]", len(body)-maxReportedEventBytes)...)
+	}
+	jhl.logger.Printf("Langfuse rejected %d of %d events (status %s), first %s event %s: %s %v, body: %s",
+		len(rejected), total, strings.Join(summary, ", "), event.Type, sample.ID, sample.Message, sample.Error, body)
+}
+
+// partialIngestionError lists the events of a batch that failed with a
+// retryable status, the other events of the batch were ingested or rejected.
+type partialIngestionError struct {
+	events []langfuse.IngestionEvent
+}
+
+func (e *partialIngestionError) Error() string {
+	return fmt.Sprintf("%d events failed with a retryable status", len(e.events))
+}
+
+// retryEvents returns the events to send again after err
+func retryEvents(batch *ingestionBatch, err error) []langfuse.IngestionEvent {
+	var partial *partialIngestionError
+	if errors.As(err, &partial) {
+		return partial.events
+	}
+	return batch.events
+}
+
+// createEvents creates the trace event and its observation event for a record
+func (jhl *LangfuseLogger) createEvents(record *LogRecord) []langfuse.IngestionEvent {
+	requestBodyText, requestBodyTruncated := record.decodeRequestBody()
+	responseBodyText, responseBodyTruncated := record.decodeResponseBody()
+	// JSON 请求体和响应体以结构化的值发送，便于在 langfuse 中查看和过滤
+	requestBody := structuredBody(requestBodyText, record.RequestContentType)
+	responseBody := structuredBody(responseBodyText, record.ResponseContentType)
 
 	// 生成 trace ID 和 span ID
-	sessionID := jhl.uuidGenerator.Generate()
-	traceID := jhl.uuidGenerator.Generate()
-	spanID := jhl.uuidGenerator.Generate()
+	traceID, spanID, parentObservationID, joined := jhl.traceIDs(record)
 	startTimestamp := record.StartTime.UTC().Format("2006-01-02T15:04:05.999Z07:00")
 	endTimestamp := record.EndTime.UTC().Format("2006-01-02T15:04:05.999Z07:00")
 
@@ -220,13 +828,15 @@ func (jhl *LangfuseLogger) sendRecord(record *LogRecord) error {
 		Name:      fmt.Sprintf("%s: %s %s", record.System, record.Method, record.URL),
 		Input: map[string]interface{}{
 			"url":  record.URL,
-			"body": requestBodyText,
+			"body": requestBody,
 		},
 		Output: map[string]interface{}{
 			"statusCode":   record.StatusCode,
-			"responseBody": responseBodyText,
+			"responseBody": responseBody,
 		},
-		SessionID: sessionID,
+		SessionID: record.SessionID,
+		UserID:    record.UserID,
+		Metadata:  traceMetadata(record),
 		Tags: []string{
 			"http",
 			record.System,
@@ -235,61 +845,176 @@ func (jhl *LangfuseLogger) sendRecord(record *LogRecord) error {
 		},
 	}
 
+	// LLM 调用使用 generation，其余请求使用 span
+	generation := parseLLMGeneration(jhl.llmParsers, record, requestBodyText, responseBodyText)
+	if generation != nil {
+		traceBody.Input = generation.Input
+		traceBody.Output = generation.Output
+		traceBody.Tags = append(traceBody.Tags, "llm", generation.Provider)
+		if joined {
+			traceBody = joinedTraceBody(traceBody)
+		}
+
+		generationBody := jhl.createGenerationBody(record, generation, requestBodyTruncated, responseBodyTruncated)
+		generationBody.ID = spanID
+		generationBody.TraceID = traceID
+		generationBody.ParentObservationID = parentObservationID
+		generationBody.StartTime = startTimestamp
+		generationBody.EndTime = endTimestamp
+		if !record.CompletionStartTime.IsZero() {
+			generationBody.CompletionStartTime = record.CompletionStartTime.UTC().Format("2006-01-02T15:04:05.999Z07:00")
+		}
+
+		return []langfuse.IngestionEvent{
+			*langfuse.CreateTraceEvent(jhl.eventID(traceID), startTimestamp, traceBody),
+			*langfuse.CreateGenerationEvent(jhl.eventID(spanID), startTimestamp, generationBody),
+		}
+	}
+	if joined {
+		traceBody = joinedTraceBody(traceBody)
+	}
+
 	// 创建 span 事件（observation）
+	input := map[string]interface{}{
+		"method":     record.Method,
+		"url":        record.URL,
+		"proto":      record.Proto,
+		"remoteAddr": record.RemoteAddr,
+		"headers":    record.RequestHeaders,
+		"body":       requestBody,
+	}
+	output := map[string]interface{}{
+		"statusCode":            record.StatusCode,
+		"statusText":            http.StatusText(record.StatusCode),
+		"responseHeaders":       record.ResponseHeaders,
+		"responseBody":          responseBody,
+		"responseContentLength": record.ResponseContentLength,
+		"durationMs":            record.DurationMs,
+	}
+	// 超过采集上限的 body 只保留了开头部分
+	if requestBodyTruncated {
+		input["bodyTruncated"] = true
+		input["contentLength"] = record.RequestContentLength
+	}
+	if responseBodyTruncated {
+		output["responseBodyTruncated"] = true
+	}
+
 	spanBody := &langfuse.ObservationBody{
-		ID:        spanID,
-		TraceID:   traceID,
-		Type:      langfuse.ObservationTypeSpan,
-		Name:      fmt.Sprintf("%s: %s %s", record.System, record.Method, record.URL),
-		StartTime: startTimestamp,
-		EndTime:   endTimestamp,
-		Input: map[string]interface{}{
-			"method":     record.Method,
-			"url":        record.URL,
-			"proto":      record.Proto,
-			"remoteAddr": record.RemoteAddr,
-			"headers":    record.RequestHeaders,
-			"body":       requestBodyText,
-		},
-		Output: map[string]interface{}{
-			"statusCode":            record.StatusCode,
-			"statusText":            http.StatusText(record.StatusCode),
-			"responseHeaders":       record.ResponseHeaders,
-			"responseBody":          responseBodyText,
-			"responseContentLength": record.ResponseContentLength,
-			"durationMs":            record.DurationMs,
-		},
-		Level: langfuse.ObservationLevelDefault,
+		ID:                  spanID,
+		TraceID:             traceID,
+		ParentObservationID: parentObservationID,
+		Type:                langfuse.ObservationTypeSpan,
+		Name:                fmt.Sprintf("%s: %s %s", record.System, record.Method, record.URL),
+		StartTime:           startTimestamp,
+		EndTime:             endTimestamp,
+		Input:               input,
+		Output:              output,
+		Level:               langfuse.ObservationLevelDefault,
 	}
 
-	// 创建 ingestion 事件
-	traceEvent := langfuse.CreateTraceEvent(traceID, startTimestamp, traceBody)
-	spanEvent := langfuse.CreateSpanEvent(spanID, startTimestamp, spanBody)
+	return []langfuse.IngestionEvent{
+		*langfuse.CreateTraceEvent(jhl.eventID(traceID), startTimestamp, traceBody),
+		*langfuse.CreateSpanEvent(jhl.eventID(spanID), startTimestamp, spanBody),
+	}
+}
 
-	// 批量发送到 langfuse
-	ingestionReq := &langfuse.IngestionRequest{
-		Batch: []langfuse.IngestionEvent{*traceEvent, *spanEvent},
-		Metadata: map[string]interface{}{
-			"source": "log2fuse",
-			"system": record.System,
-		},
+// traceIDs returns the langfuse trace and observation ids of a record.
+// The W3C trace id and span id are reused, so that the spans of the
+// upstream traced with the same traceparent join the trace; the
+// X-Langfuse-* headers take precedence. joined tells whether the trace
+// is owned by a Langfuse SDK, which only the X-Langfuse-Trace-Id header
+// tells: a traceparent alone usually comes from a tracer that does not
+// write to Langfuse, so the trace keeps its name, input and output.
+func (jhl *LangfuseLogger) traceIDs(record *LogRecord) (traceID, observationID, parentObservationID string, joined bool) {
+	traceID = record.TraceID
+	observationID = record.SpanID
+	parentObservationID = record.ParentSpanID
+	if traceID == "" || observationID == "" {
+		traceID = jhl.uuidGenerator.Generate()
+		observationID = jhl.uuidGenerator.Generate()
 	}
 
-	// 发送到 langfuse
-	resp, err := jhl.client.Ingest(jhl.ctx, ingestionReq)
-	if err != nil {
-		return fmt.Errorf("failed to send to langfuse: %w", err)
+	if record.LangfuseTraceID != "" {
+		traceID = record.LangfuseTraceID
+		parentObservationID = record.LangfuseParentObservationID
 	}
 
-	// 记录发送结果
-	if len(resp.Successes) > 0 {
-		jhl.logger.Printf("Successfully sent %d events to langfuse", len(resp.Successes))
+	return traceID, observationID, parentObservationID, record.LangfuseTraceID != ""
+}
+
+// eventID returns the id of an ingestion event, distinct from the id of its entity
+func (jhl *LangfuseLogger) eventID(entityID string) string {
+	if id := jhl.uuidGenerator.Generate(); id != "" {
+		return id
 	}
-	if len(resp.Errors) > 0 {
-		jhl.logger.Printf("Failed to send %d events to langfuse: %+v", len(resp.Errors), resp.Errors)
+	return entityID
+}
+
+// joinedTraceBody keeps only the tags and session of a trace started by
+// someone else, so that its name, input and output are not overwritten.
+func joinedTraceBody(traceBody *langfuse.TraceBody) *langfuse.TraceBody {
+	return &langfuse.TraceBody{
+		ID:        traceBody.ID,
+		SessionID: traceBody.SessionID,
+		UserID:    traceBody.UserID,
+		Metadata:  traceBody.Metadata,
+		Tags:      traceBody.Tags,
 	}
+}
 
-	return nil
+// traceMetadata returns the metadata of the trace of a record, nil when empty
+func traceMetadata(record *LogRecord) interface{} {
+	if len(record.JWTClaims) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"jwtClaims": record.JWTClaims}
+}
+
+// createGenerationBody maps a parsed LLM call to a generation observation,
+// keeping the HTTP details of the exchange in its metadata
+func (jhl *LangfuseLogger) createGenerationBody(record *LogRecord, generation *LLMGeneration, requestBodyTruncated, responseBodyTruncated bool) *langfuse.ObservationBody {
+	level := langfuse.ObservationLevelDefault
+	if record.StatusCode >= http.StatusBadRequest {
+		level = langfuse.ObservationLevelError
+	}
+
+	metadata := map[string]interface{}{
+		"provider":              generation.Provider,
+		"method":                record.Method,
+		"url":                   record.URL,
+		"proto":                 record.Proto,
+		"remoteAddr":            record.RemoteAddr,
+		"requestHeaders":        record.RequestHeaders,
+		"statusCode":            record.StatusCode,
+		"responseHeaders":       record.ResponseHeaders,
+		"responseContentLength": record.ResponseContentLength,
+		"durationMs":            record.DurationMs,
+	}
+	if requestBodyTruncated {
+		metadata["requestBodyTruncated"] = true
+		metadata["requestContentLength"] = record.RequestContentLength
+	}
+	if responseBodyTruncated {
+		metadata["responseBodyTruncated"] = true
+	}
+	for key, value := range generation.Metadata {
+		metadata[key] = value
+	}
+
+	return &langfuse.ObservationBody{
+		Type:            langfuse.ObservationTypeGeneration,
+		Name:            fmt.Sprintf("%s: %s %s", record.System, record.Method, record.URL),
+		Model:           generation.Model,
+		ModelParameters: generation.ModelParameters,
+		Input:           generation.Input,
+		Output:          generation.Output,
+		Usage:           generation.Usage,
+		UsageDetails:    generation.UsageDetails,
+		Metadata:        metadata,
+		Level:           level,
+		StatusMessage:   generation.StatusMessage,
+	}
 }
 
 // isInProbeMode checks if the client is currently in probe mode
@@ -302,7 +1027,7 @@ func (jhl *LangfuseLogger) isInProbeMode() bool {
 // StartHealthProbe starts a background health probe when in probe mode
 func (jhl *LangfuseLogger) StartHealthProbe() {
 	go func() {
-		ticker := time.NewTicker(10 * time.Second) // 每10秒检查一次
+		ticker := time.NewTicker(jhl.options.HealthProbeInterval) // 默认每10秒检查一次
 		defer ticker.Stop()
 
 		for {
@@ -311,7 +1036,12 @@ func (jhl *LangfuseLogger) StartHealthProbe() {
 				if jhl.isInProbeMode() {
 					if jhl.isClientHealthy() {
 						jhl.logger.Printf("Health probe detected recovery, exiting probe mode")
-						break
+						jhl.markHealthy()
+						// 通知处理goroutine回放 spool
+						select {
+						case jhl.recovered <- struct{}{}:
+						default:
+						}
 					}
 				} else {
 					// 不在探测模式下，继续等待
@@ -324,13 +1054,56 @@ func (jhl *LangfuseLogger) StartHealthProbe() {
 	}()
 }
 
-// Stop stops the background processor
+// Stop stops the background processor, dropping the queued records
 func (jhl *LangfuseLogger) Stop() {
 	jhl.cancel()
 }
 
-// Close closes the logger and cleans up resources
+// Shutdown stops accepting records, then sends the queued records and the
+// last batch. It returns once they are sent, or when ctx is done: the
+// records not sent by then are lost, or spooled when a spool is configured.
+func (jhl *LangfuseLogger) Shutdown(ctx context.Context) error {
+	first := false
+	var before recordStats
+	jhl.shutdownOnce.Do(func() {
+		first = true
+		// 在开始排空之前取统计快照，排空期间发送的记录也计入
+		before = jhl.recordStats()
+		// 等待正在进入 chain 的记录，之后的记录不再进入
+		jhl.closeMutex.Lock()
+		jhl.closed = true
+		jhl.closeMutex.Unlock()
+		close(jhl.shutdown)
+	})
+	if !first {
+		<-jhl.drained
+		return nil
+	}
+
+	var err error
+	select {
+	case <-jhl.drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// 超时，中断正在进行的发送
+		jhl.cancel()
+		<-jhl.drained
+	}
+	jhl.cancel()
+
+	after := jhl.recordStats()
+	jhl.logger.Printf("Langfuse logger shut down: %d records flushed, %d spooled, %d lost",
+		after.sent-before.sent, after.spooled-before.spooled, after.lost-before.lost)
+
+	return err
+}
+
+// Close shuts the logger down within the configured shutdown timeout
 func (jhl *LangfuseLogger) Close() {
-	jhl.Stop()
-	close(jhl.chain)
+	ctx, cancel := context.WithTimeout(context.Background(), jhl.options.ShutdownTimeout)
+	defer cancel()
+
+	if err := jhl.Shutdown(ctx); err != nil {
+		jhl.logger.Printf("Langfuse logger shutdown timed out: %v", err)
+	}
 }
@@ -17,28 +17,35 @@ type JSONHTTPLogger struct {
 	writer        LogWriter
 }
 
-func (jhl *JSONHTTPLogger) print(record *LogRecord) {
-	requestBodyText, _ := record.RequestBodyDecoder.decode(record.RequestBody)
-	responseBodyText, _ := record.ResponseBodyDecoder.decode(record.ResponseBody)
+// Print prints the HTTP log as an ECS JSON line.
+func (jhl *JSONHTTPLogger) Print(record *LogRecord) {
+	requestBodyText, requestBodyTruncated := record.decodeRequestBody()
+	responseBodyText, responseBodyTruncated := record.decodeResponseBody()
 	logData := struct {
-		Level                 string              `json:"log.level,omitempty"`
-		Time                  string              `json:"@timestamp"`
-		Message               string              `json:"message,omitempty"`
-		System                string              `json:"systemName,omitempty"`
-		RemoteAddr            string              `json:"remoteAddress,omitempty"`
-		Method                string              `json:"method"`
-		URL                   string              `json:"path"`
-		Status                int                 `json:"status"`
-		StatusText            string              `json:"statusText"`
-		Proto                 string              `json:"proto"`
-		DurationMs            float64             `json:"durationMs"`
-		RequestHeaders        map[string][]string `json:"requestHeaders,omitempty"`
-		RequestBody           string              `json:"requestBody,omitempty"`
-		ResponseHeaders       map[string][]string `json:"responseHeaders,omitempty"`
-		ResponseContentLength int                 `json:"responseContentLength"`
-		ResponseBody          string              `json:"responseBody,omitempty"`
-		EcsVersion            string              `json:"ecs.version,omitempty"`
-		LogID                 string              `json:"logId,omitempty"`
+		Level                 string                 `json:"log.level,omitempty"`
+		Time                  string                 `json:"@timestamp"`
+		Message               string                 `json:"message,omitempty"`
+		System                string                 `json:"systemName,omitempty"`
+		RemoteAddr            string                 `json:"remoteAddress,omitempty"`
+		Method                string                 `json:"method"`
+		URL                   string                 `json:"path"`
+		Status                int                    `json:"status"`
+		StatusText            string                 `json:"statusText"`
+		Proto                 string                 `json:"proto"`
+		DurationMs            float64                `json:"durationMs"`
+		RequestHeaders        map[string][]string    `json:"requestHeaders,omitempty"`
+		RequestBody           interface{}            `json:"requestBody,omitempty"`
+		RequestContentLength  int                    `json:"requestContentLength,omitempty"`
+		RequestBodyTruncated  bool                   `json:"requestBodyTruncated,omitempty"`
+		ResponseHeaders       map[string][]string    `json:"responseHeaders,omitempty"`
+		ResponseContentLength int                    `json:"responseContentLength"`
+		ResponseBody          interface{}            `json:"responseBody,omitempty"`
+		ResponseBodyTruncated bool                   `json:"responseBodyTruncated,omitempty"`
+		EcsVersion            string                 `json:"ecs.version,omitempty"`
+		LogID                 string                 `json:"logId,omitempty"`
+		SessionID             string                 `json:"sessionId,omitempty"`
+		UserID                string                 `json:"userId,omitempty"`
+		JWTClaims             map[string]interface{} `json:"jwtClaims,omitempty"`
 	}{
 		Level:                 "info",
 		Time:                  jhl.clock.Now().UTC().Format("2006-01-02T15:04:05.999Z07:00"),
@@ -52,12 +59,27 @@ func (jhl *JSONHTTPLogger) print(record *LogRecord) {
 		Proto:                 record.Proto,
 		DurationMs:            record.DurationMs,
 		RequestHeaders:        record.RequestHeaders,
-		RequestBody:           requestBodyText,
+		RequestBodyTruncated:  requestBodyTruncated,
 		ResponseHeaders:       record.ResponseHeaders,
 		ResponseContentLength: record.ResponseContentLength,
-		ResponseBody:          responseBodyText,
+		ResponseBodyTruncated: responseBodyTruncated,
 		EcsVersion:            "1.6.0",
 		LogID:                 jhl.uuidGenerator.Generate(),
+		SessionID:             record.SessionID,
+		UserID:                record.UserID,
+		JWTClaims:             record.JWTClaims,
+	}
+
+	// JSON bodies are embedded as values, empty bodies are left out
+	if requestBodyText != "" {
+		logData.RequestBody = structuredBody(requestBodyText, record.RequestContentType)
+	}
+	if responseBodyText != "" {
+		logData.ResponseBody = structuredBody(responseBodyText, record.ResponseContentType)
+	}
+	if requestBodyTruncated {
+		// the total length only matters when the logged body is not complete
+		logData.RequestContentLength = record.RequestContentLength
 	}
 
 	logBytes, err := json.Marshal(logData)
@@ -0,0 +1,14 @@
+// Package log2fuse a Traefik HTTP logger plugin.
+package log2fuse
+
+// MultiHTTPLogger fans every record out to several loggers.
+type MultiHTTPLogger struct {
+	loggers []HTTPLogger
+}
+
+// Print prints the HTTP log with every logger, in order.
+func (mhl *MultiHTTPLogger) Print(record *LogRecord) {
+	for _, logger := range mhl.loggers {
+		logger.Print(record)
+	}
+}
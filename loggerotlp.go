@@ -0,0 +1,397 @@
+// Package log2fuse a Traefik HTTP logger plugin.
+package log2fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peace0phmind/log2fuse/langfuse"
+)
+
+// OTLPHTTPLoggerOptions configures an OTLPHTTPLogger.
+type OTLPHTTPLoggerOptions struct {
+	// Endpoint is the full URL of the traces endpoint, like http://collector:4318/v1/traces.
+	Endpoint string
+	// Encoding is OTLPEncodingProtobuf (default) or OTLPEncodingJSON.
+	Encoding string
+	// Headers are added to every export request, e.g. Authorization.
+	Headers map[string]string
+	// ServiceName is the service.name resource attribute.
+	ServiceName string
+	// BatchMaxSpans flushes a batch once it holds this many spans.
+	BatchMaxSpans int
+	// BatchFlushInterval flushes a non-empty batch at least this often.
+	BatchFlushInterval time.Duration
+	// ShutdownTimeout bounds the time Close waits for the queued spans to be exported.
+	ShutdownTimeout time.Duration
+	// Clock times the backoff after a failed export, the system clock when nil.
+	Clock LoggerClock
+}
+
+// OTLPHTTPLogger exports every record as an OTLP/HTTP server span.
+//
+// The span is a child of the incoming traceparent when there is one,
+// LLM calls get the gen_ai.* semantic-convention attributes.
+type OTLPHTTPLogger struct {
+	logger     *log.Logger
+	options    OTLPHTTPLoggerOptions
+	httpClient *http.Client
+	llmParsers []LLMParser
+
+	chain        chan *LogRecord
+	shutdown     chan struct{}
+	drained      chan struct{}
+	shutdownOnce sync.Once
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	// 导出失败的批次等待退避结束后重试，只由处理 goroutine 访问
+	backoff backoff
+	retries []*otlpExport
+}
+
+// otlpExport is an encoded export request, kept to be sent again after a retryable failure
+type otlpExport struct {
+	body     []byte
+	spans    int
+	attempts int
+}
+
+// otlpExportError is a rejected export request
+type otlpExportError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *otlpExportError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.status, e.message)
+}
+
+// isRetryableOTLPError tells whether an export may be sent again: the network
+// errors and the statuses the OTLP/HTTP specification marks as retryable
+func isRetryableOTLPError(err error) bool {
+	var exportErr *otlpExportError
+	if !errors.As(err, &exportErr) {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch exportErr.status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// NewOTLPHTTPLogger creates the logger and starts its exporter goroutine.
+func NewOTLPHTTPLogger(logger *log.Logger, options OTLPHTTPLoggerOptions) *OTLPHTTPLogger {
+	if options.Encoding != OTLPEncodingJSON {
+		options.Encoding = OTLPEncodingProtobuf
+	}
+	if options.BatchMaxSpans <= 0 {
+		options.BatchMaxSpans = defaultBatchMaxEvents
+	}
+	if options.BatchFlushInterval <= 0 {
+		options.BatchFlushInterval = defaultBatchFlushInterval
+	}
+	if options.ShutdownTimeout <= 0 {
+		options.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if options.Clock == nil {
+		options.Clock = &SystemLoggerClock{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ohl := &OTLPHTTPLogger{
+		logger:     logger,
+		options:    options,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		llmParsers: createLLMParsers(),
+		chain:      make(chan *LogRecord, 1000),
+		shutdown:   make(chan struct{}),
+		drained:    make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		backoff:    backoff{clock: options.Clock},
+	}
+	go ohl.process()
+	return ohl
+}
+
+// Print queues the record for export, it never blocks the request.
+func (ohl *OTLPHTTPLogger) Print(record *LogRecord) {
+	select {
+	case <-ohl.shutdown:
+		ohl.logger.Printf("Dropping record, the OTLP exporter is shut down")
+		return
+	default:
+	}
+
+	select {
+	case ohl.chain <- record:
+	default:
+		ohl.logger.Printf("OTLP export queue is full, dropping record")
+	}
+}
+
+// Close exports the queued records within the shutdown timeout.
+func (ohl *OTLPHTTPLogger) Close() {
+	ohl.shutdownOnce.Do(func() {
+		close(ohl.shutdown)
+	})
+
+	select {
+	case <-ohl.drained:
+	case <-time.After(ohl.options.ShutdownTimeout):
+		ohl.logger.Printf("OTLP exporter shutdown timed out, %d records lost", len(ohl.chain))
+		// 中断正在进行的导出和退避等待
+		ohl.cancel()
+		<-ohl.drained
+	}
+	ohl.cancel()
+}
+
+func (ohl *OTLPHTTPLogger) process() {
+	defer close(ohl.drained)
+
+	ticker := time.NewTicker(ohl.options.BatchFlushInterval)
+	defer ticker.Stop()
+
+	var spans []otlpSpan
+	for {
+		select {
+		case record := <-ohl.chain:
+			spans = append(spans, ohl.createSpan(record))
+			if len(spans) >= ohl.options.BatchMaxSpans {
+				ohl.export(spans)
+				spans = nil
+			}
+		case <-ticker.C:
+			ohl.processRetries()
+			if len(spans) > 0 {
+				ohl.export(spans)
+				spans = nil
+			}
+		case <-ohl.shutdown:
+			for len(ohl.chain) > 0 {
+				spans = append(spans, ohl.createSpan(<-ohl.chain))
+			}
+			if len(spans) > 0 {
+				ohl.export(spans)
+			}
+			// 关闭时等待退避结束再重试，超时后放弃
+			for len(ohl.retries) > 0 {
+				if err := ohl.backoff.wait(ohl.ctx); err != nil {
+					ohl.logger.Printf("OTLP exporter shut down, dropping %d batches waiting for a retry", len(ohl.retries))
+					return
+				}
+				ohl.processRetries()
+			}
+			return
+		}
+	}
+}
+
+// export encodes the spans in a single request and sends it, unless earlier
+// requests wait for the backoff: then it is queued after them.
+func (ohl *OTLPHTTPLogger) export(spans []otlpSpan) {
+	var body []byte
+	if ohl.options.Encoding == OTLPEncodingJSON {
+		data, err := encodeOTLPJSON(ohl.options.ServiceName, spans)
+		if err != nil {
+			ohl.logger.Printf("Failed to encode %d OTLP spans: %v", len(spans), err)
+			return
+		}
+		body = data
+	} else {
+		body = encodeOTLPProtobuf(ohl.options.ServiceName, spans)
+	}
+
+	if len(ohl.retries) >= maxRetryBatches {
+		ohl.logger.Printf("Dropping %d OTLP spans waiting for the backoff, too many batches are waiting", ohl.retries[0].spans)
+		ohl.retries = ohl.retries[1:]
+	}
+	ohl.retries = append(ohl.retries, &otlpExport{body: body, spans: len(spans)})
+	ohl.processRetries()
+}
+
+// processRetries sends the queued exports in order while the backoff allows it
+func (ohl *OTLPHTTPLogger) processRetries() {
+	for len(ohl.retries) > 0 && !ohl.backoff.active() {
+		export := ohl.retries[0]
+		ohl.retries = ohl.retries[1:]
+		if !ohl.attemptExport(export) {
+			return
+		}
+	}
+}
+
+// attemptExport sends a queued export once. A retryable failure extends the
+// shared backoff and puts it back at the head of the queue, until it has been
+// attempted maxBatchAttempts times. Returns false when the export was put back.
+func (ohl *OTLPHTTPLogger) attemptExport(export *otlpExport) bool {
+	export.attempts++
+	err := ohl.send(export)
+	if err == nil {
+		ohl.backoff.succeed()
+		return true
+	}
+	if !isRetryableOTLPError(err) {
+		ohl.logger.Printf("Failed to export %d OTLP spans, dropping them without retrying: %v", export.spans, err)
+		return true
+	}
+
+	var retryAfter time.Duration
+	var exportErr *otlpExportError
+	if errors.As(err, &exportErr) {
+		retryAfter = exportErr.retryAfter
+	}
+	delay := ohl.backoff.fail(retryAfter)
+	if export.attempts >= maxBatchAttempts {
+		ohl.logger.Printf("Failed to export %d OTLP spans after %d attempts: %v", export.spans, maxBatchAttempts, err)
+		return true
+	}
+	ohl.logger.Printf("Failed to export %d OTLP spans (attempt %d/%d), retrying in %s: %v", export.spans, export.attempts, maxBatchAttempts, delay, err)
+	ohl.retries = append([]*otlpExport{export}, ohl.retries...)
+	return false
+}
+
+// send posts an export request and logs the spans the collector rejected in a partial success
+func (ohl *OTLPHTTPLogger) send(export *otlpExport) error {
+	contentType := "application/x-protobuf"
+	if ohl.options.Encoding == OTLPEncodingJSON {
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ohl.ctx, http.MethodPost, ohl.options.Endpoint, bytes.NewReader(export.body))
+	if err != nil {
+		return &otlpExportError{message: err.Error()}
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range ohl.options.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := ohl.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &otlpExportError{
+			status:     resp.StatusCode,
+			message:    string(message),
+			retryAfter: langfuse.ParseRetryAfter(resp.Header.Get("Retry-After"), ohl.options.Clock.Now()),
+		}
+	}
+
+	// 部分成功：被拒绝的 span 重试也不会成功，只记录数量
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if rejected, message := decodeOTLPPartialSuccess(ohl.options.Encoding, body); rejected > 0 {
+		ohl.logger.Printf("OTLP collector rejected %d of %d spans: %s", rejected, export.spans, message)
+	}
+	return nil
+}
+
+// createSpan maps a record to a server span with the HTTP semantic-convention attributes
+func (ohl *OTLPHTTPLogger) createSpan(record *LogRecord) otlpSpan {
+	span := otlpSpan{
+		traceID:      record.TraceID,
+		spanID:       record.SpanID,
+		parentSpanID: record.ParentSpanID,
+		name:         record.Method,
+		kind:         otlpSpanKindServer,
+		startTime:    record.StartTime.UnixNano(),
+		endTime:      record.EndTime.UnixNano(),
+	}
+	if span.traceID == "" || span.spanID == "" {
+		span.traceID = randomHex(16)
+		span.spanID = randomHex(8)
+	}
+
+	span.set("http.request.method", record.Method)
+	if u, err := url.Parse(record.URL); err == nil {
+		span.set("url.path", u.Path)
+		span.set("url.query", u.RawQuery)
+	}
+	span.set("network.protocol.name", "http")
+	span.set("network.protocol.version", strings.TrimPrefix(record.Proto, "HTTP/"))
+	if host, _, err := net.SplitHostPort(record.RemoteAddr); err == nil {
+		span.set("client.address", host)
+	} else {
+		span.set("client.address", record.RemoteAddr)
+	}
+	span.set("user_agent.original", record.RequestHeaders.Get("User-Agent"))
+	span.set("http.request.body.size", record.RequestContentLength)
+	span.set("http.response.status_code", record.StatusCode)
+	span.set("http.response.body.size", record.ResponseContentLength)
+	span.set("session.id", record.SessionID)
+	span.set("user.id", record.UserID)
+	requestBodyText, requestBodyTruncated := record.decodeRequestBody()
+	responseBodyText, responseBodyTruncated := record.decodeResponseBody()
+	if requestBodyTruncated {
+		span.set("log2fuse.request.body.truncated", true)
+	}
+	if responseBodyTruncated {
+		span.set("log2fuse.response.body.truncated", true)
+	}
+	if record.StatusCode >= http.StatusInternalServerError {
+		span.statusCode = otlpStatusCodeError
+		span.set("error.type", fmt.Sprintf("%d", record.StatusCode))
+	}
+
+	if generation := parseLLMGeneration(ohl.llmParsers, record, requestBodyText, responseBodyText); generation != nil {
+		setGenAIAttributes(&span, generation)
+	}
+
+	return span
+}
+
+// setGenAIAttributes adds the gen_ai.* semantic-convention attributes of an LLM call
+func setGenAIAttributes(span *otlpSpan, generation *LLMGeneration) {
+	span.name = strings.TrimSpace("chat " + generation.Model)
+	span.set("gen_ai.operation.name", "chat")
+	span.set("gen_ai.system", generation.Provider)
+	span.set("gen_ai.request.model", generation.Model)
+	span.set("gen_ai.response.model", generation.Model)
+
+	if maxTokens, ok := generation.ModelParameters["max_tokens"].(float64); ok {
+		span.set("gen_ai.request.max_tokens", int64(maxTokens))
+	}
+	for _, key := range []string{"temperature", "top_p"} {
+		if value, ok := generation.ModelParameters[key].(float64); ok {
+			span.set("gen_ai.request."+key, value)
+		}
+	}
+	if generation.Usage != nil {
+		span.set("gen_ai.usage.input_tokens", generation.Usage.Input)
+		span.set("gen_ai.usage.output_tokens", generation.Usage.Output)
+	}
+	if id, ok := generation.Metadata["messageId"].(string); ok {
+		span.set("gen_ai.response.id", id)
+	}
+
+	if input, err := json.Marshal(generation.Input); err == nil && generation.Input != nil {
+		span.set("gen_ai.prompt", string(input))
+	}
+	if output, err := json.Marshal(generation.Output); err == nil && generation.Output != nil {
+		span.set("gen_ai.completion", string(output))
+	}
+
+	if generation.StatusMessage != "" {
+		span.statusCode = otlpStatusCodeError
+		span.statusMessage = generation.StatusMessage
+	}
+}
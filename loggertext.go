@@ -0,0 +1,68 @@
+// Package log2fuse a Traefik HTTP logger plugin.
+package log2fuse
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TextHTTPLogger a human readable text logger implementation.
+type TextHTTPLogger struct {
+	clock  LoggerClock
+	logger *log.Logger
+	writer LogWriter
+}
+
+// Print prints the HTTP log as a multi-line text block.
+func (thl *TextHTTPLogger) Print(record *LogRecord) {
+	requestBodyText, requestBodyTruncated := record.decodeRequestBody()
+	responseBodyText, responseBodyTruncated := record.decodeResponseBody()
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "[%s] %s %s %s %s: %d %s %s\n",
+		record.System, thl.clock.Now().Format("2006/01/02 15:04:05"), record.RemoteAddr,
+		record.Method, record.URL, record.StatusCode, http.StatusText(record.StatusCode), record.Proto)
+	writeTextHeaders(&builder, "Request Headers", record.RequestHeaders)
+	writeTextBody(&builder, "Request Body", requestBodyText, requestBodyTruncated, record.RequestContentLength)
+	writeTextHeaders(&builder, "Response Headers", record.ResponseHeaders)
+	fmt.Fprintf(&builder, "\nResponse Content Length: %d\n", record.ResponseContentLength)
+	writeTextBody(&builder, "Response Body", responseBodyText, responseBodyTruncated, record.ResponseContentLength)
+	builder.WriteString("\n")
+
+	err := thl.writer.Write(builder.String())
+	if err != nil {
+		thl.logger.Println("Failed to write:", err)
+		return
+	}
+}
+
+func writeTextHeaders(builder *strings.Builder, title string, headers http.Header) {
+	if len(headers) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(builder, "\n%s:\n", title)
+	for _, key := range keys {
+		for _, value := range headers[key] {
+			fmt.Fprintf(builder, "%s: %s\n", key, value)
+		}
+	}
+}
+
+func writeTextBody(builder *strings.Builder, title string, body string, truncated bool, length int) {
+	if len(body) == 0 {
+		return
+	}
+	fmt.Fprintf(builder, "\n%s:\n%s\n", title, body)
+	if truncated {
+		fmt.Fprintf(builder, "[truncated, %d bytes in total]\n", length)
+	}
+}
@@ -0,0 +1,335 @@
+package log2fuse
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// OTLP encodings of the exported spans
+const (
+	OTLPEncodingProtobuf = "protobuf"
+	OTLPEncodingJSON     = "json"
+)
+
+// OTLP span kinds and status codes, see opentelemetry/proto/trace/v1/trace.proto
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusCodeError = 2
+)
+
+const otlpScopeName = "github.com/peace0phmind/log2fuse"
+
+// otlpSpan is the subset of an OTLP span the exporter fills.
+type otlpSpan struct {
+	traceID       string // hex
+	spanID        string // hex
+	parentSpanID  string // hex, empty for a root span
+	name          string
+	kind          int
+	startTime     int64 // unix nanoseconds
+	endTime       int64 // unix nanoseconds
+	attributes    []otlpAttribute
+	statusCode    int
+	statusMessage string
+}
+
+// otlpAttribute is a key with a string, bool, int64, float64 or []string value.
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+func (s *otlpSpan) set(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return
+		}
+	case int:
+		value = int64(v)
+	case nil:
+		return
+	}
+	s.attributes = append(s.attributes, otlpAttribute{key: key, value: value})
+}
+
+// encodeOTLPJSON encodes an ExportTraceServiceRequest with the OTLP/JSON mapping:
+// ids are hex strings, 64 bit integers are strings and enums are numbers.
+func encodeOTLPJSON(serviceName string, spans []otlpSpan) ([]byte, error) {
+	jsonSpans := make([]interface{}, 0, len(spans))
+	for _, span := range spans {
+		jsonSpan := map[string]interface{}{
+			"traceId":           span.traceID,
+			"spanId":            span.spanID,
+			"name":              span.name,
+			"kind":              span.kind,
+			"startTimeUnixNano": strconv.FormatInt(span.startTime, 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.endTime, 10),
+			"attributes":        otlpJSONAttributes(span.attributes),
+			"status": map[string]interface{}{
+				"code":    span.statusCode,
+				"message": span.statusMessage,
+			},
+		}
+		if span.parentSpanID != "" {
+			jsonSpan["parentSpanId"] = span.parentSpanID
+		}
+		jsonSpans = append(jsonSpans, jsonSpan)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpJSONAttributes([]otlpAttribute{{key: "service.name", value: serviceName}}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": otlpScopeName},
+						"spans": jsonSpans,
+					},
+				},
+			},
+		},
+	})
+}
+
+func otlpJSONAttributes(attributes []otlpAttribute) []interface{} {
+	result := make([]interface{}, 0, len(attributes))
+	for _, attribute := range attributes {
+		result = append(result, map[string]interface{}{
+			"key":   attribute.key,
+			"value": otlpJSONValue(attribute.value),
+		})
+	}
+	return result
+}
+
+func otlpJSONValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case []string:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			values = append(values, otlpJSONValue(item))
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	default:
+		return map[string]interface{}{"stringValue": v}
+	}
+}
+
+// protoBuffer writes the protobuf wire format, only what the OTLP messages need.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	b.data = binary.AppendUvarint(b.data, v)
+}
+
+func (b *protoBuffer) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) bytesField(field int, value []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(value)))
+	b.data = append(b.data, value...)
+}
+
+func (b *protoBuffer) stringField(field int, value string) {
+	if value == "" {
+		return
+	}
+	b.bytesField(field, []byte(value))
+}
+
+func (b *protoBuffer) hexField(field int, value string) {
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return
+	}
+	b.bytesField(field, decoded)
+}
+
+func (b *protoBuffer) varintField(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	b.tag(field, 0)
+	b.varint(value)
+}
+
+func (b *protoBuffer) fixed64Field(field int, value uint64) {
+	b.tag(field, 1)
+	b.data = binary.LittleEndian.AppendUint64(b.data, value)
+}
+
+func (b *protoBuffer) messageField(field int, message *protoBuffer) {
+	b.bytesField(field, message.data)
+}
+
+// encodeOTLPProtobuf encodes an ExportTraceServiceRequest as protobuf.
+func encodeOTLPProtobuf(serviceName string, spans []otlpSpan) []byte {
+	scopeSpans := &protoBuffer{}
+	scope := &protoBuffer{}
+	scope.stringField(1, otlpScopeName) // InstrumentationScope.name
+	scopeSpans.messageField(1, scope)   // ScopeSpans.scope
+	for _, span := range spans {
+		scopeSpans.messageField(2, encodeProtoSpan(span)) // ScopeSpans.spans
+	}
+
+	resource := &protoBuffer{}
+	resource.messageField(1, encodeProtoAttribute(otlpAttribute{key: "service.name", value: serviceName})) // Resource.attributes
+
+	resourceSpans := &protoBuffer{}
+	resourceSpans.messageField(1, resource)   // ResourceSpans.resource
+	resourceSpans.messageField(2, scopeSpans) // ResourceSpans.scope_spans
+
+	request := &protoBuffer{}
+	request.messageField(1, resourceSpans) // ExportTraceServiceRequest.resource_spans
+	return request.data
+}
+
+func encodeProtoSpan(span otlpSpan) *protoBuffer {
+	b := &protoBuffer{}
+	b.hexField(1, span.traceID)
+	b.hexField(2, span.spanID)
+	b.hexField(4, span.parentSpanID)
+	b.stringField(5, span.name)
+	b.varintField(6, uint64(span.kind))
+	b.fixed64Field(7, uint64(span.startTime))
+	b.fixed64Field(8, uint64(span.endTime))
+	for _, attribute := range span.attributes {
+		b.messageField(9, encodeProtoAttribute(attribute))
+	}
+
+	status := &protoBuffer{}
+	status.stringField(2, span.statusMessage)
+	status.varintField(3, uint64(span.statusCode))
+	b.messageField(15, status)
+	return b
+}
+
+func encodeProtoAttribute(attribute otlpAttribute) *protoBuffer {
+	b := &protoBuffer{}
+	b.stringField(1, attribute.key)                      // KeyValue.key
+	b.messageField(2, encodeProtoValue(attribute.value)) // KeyValue.value
+	return b
+}
+
+// encodeProtoValue encodes an AnyValue
+func encodeProtoValue(value interface{}) *protoBuffer {
+	b := &protoBuffer{}
+	switch v := value.(type) {
+	case bool:
+		b.tag(2, 0)
+		if v {
+			b.varint(1)
+		} else {
+			b.varint(0)
+		}
+	case int64:
+		b.tag(3, 0)
+		b.varint(uint64(v))
+	case float64:
+		b.fixed64Field(4, math.Float64bits(v))
+	case []string:
+		array := &protoBuffer{}
+		for _, item := range v {
+			array.messageField(1, encodeProtoValue(item)) // ArrayValue.values
+		}
+		b.messageField(5, array)
+	case string:
+		b.bytesField(1, []byte(v))
+	}
+	return b
+}
+
+// decodeOTLPPartialSuccess reads the partial_success of an ExportTraceServiceResponse
+// in the given encoding. Returns no rejected spans when the response has none.
+func decodeOTLPPartialSuccess(encoding string, body []byte) (int64, string) {
+	if encoding == OTLPEncodingJSON {
+		var response struct {
+			PartialSuccess struct {
+				// 64 位整数在 OTLP/JSON 中是字符串，也接受数字
+				RejectedSpans json.Number `json:"rejectedSpans"`
+				ErrorMessage  string      `json:"errorMessage"`
+			} `json:"partialSuccess"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return 0, ""
+		}
+		rejected, _ := response.PartialSuccess.RejectedSpans.Int64()
+		return rejected, response.PartialSuccess.ErrorMessage
+	}
+
+	var rejected int64
+	var message string
+	readProtoFields(body, func(field int, _ uint64, data []byte) {
+		if field != 1 {
+			return
+		}
+		readProtoFields(data, func(field int, value uint64, data []byte) {
+			switch field {
+			case 1:
+				rejected = int64(value)
+			case 2:
+				message = string(data)
+			}
+		})
+	})
+	return rejected, message
+}
+
+// readProtoFields calls visit with the varint value or the bytes of each field
+// of a protobuf message. It stops at the first malformed field.
+func readProtoFields(data []byte, visit func(field int, value uint64, data []byte)) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return
+			}
+			data = data[n:]
+			visit(field, value, nil)
+		case 1:
+			if len(data) < 8 {
+				return
+			}
+			visit(field, binary.LittleEndian.Uint64(data), nil)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return
+			}
+			visit(field, 0, data[n:n+int(length)])
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return
+			}
+			visit(field, uint64(binary.LittleEndian.Uint32(data)), nil)
+			data = data[4:]
+		default:
+			return
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,22 +18,74 @@ import (
 	"github.com/peace0phmind/log2fuse/langfuse"
 )
 
+// Log formats, several of them can be combined in Config.LogFormat like "json,langfuse".
+const (
+	// LogFormatJSON prints ECS JSON lines to stdout.
+	LogFormatJSON = "json"
+	// LogFormatText prints human readable text blocks to stdout.
+	LogFormatText = "text"
+	// LogFormatLangfuse sends traces to Langfuse.
+	LogFormatLangfuse = "langfuse"
+	// LogFormatOTLP exports spans to an OpenTelemetry collector over OTLP/HTTP.
+	LogFormatOTLP = "otlp"
+)
+
+// What happens to the JWT claims missing from Config.JWTClaims.
+const (
+	// JWTClaimsModeDrop leaves them out.
+	JWTClaimsModeDrop = "drop"
+	// JWTClaimsModeHash replaces their values by their HMAC-SHA256 keyed with Config.JWTClaimsSalt,
+	// or with a random salt of the process when it is empty.
+	JWTClaimsModeHash = "hash"
+)
+
 // Config the plugin configuration.
 type Config struct {
-	Enabled            bool     `json:"enabled"`
-	Debug              bool     `json:"debug"`
-	GenerateLogID      bool     `json:"generateLogId,omitempty"`
-	Name               string   `json:"name,omitempty"`
-	AcceptAny          bool     `json:"acceptAny,omitempty"`
-	SilentHeaders      bool     `json:"silentHeaders,omitempty"`
-	BodyContentTypes   []string `json:"bodyContentTypes,omitempty"`
-	JWTHeaders         []string `json:"jwtHeaders,omitempty"`
-	HeaderRedacts      []string `json:"headerRedacts,omitempty"`
-	RequestBodyRedact  string   `json:"requestBodyRedact,omitempty"`
-	ResponseBodyRedact string   `json:"responseBodyRedact,omitempty"`
-	LangfuseHost       string   `json:"langfuseHost,omitempty"`
-	LangfusePublicKey  string   `json:"langfusePublicKey,omitempty"`
-	LangfuseSecretKey  string   `json:"langfuseSecretKey,omitempty"`
+	Enabled              bool              `json:"enabled"`
+	Debug                bool              `json:"debug"`
+	GenerateLogID        bool              `json:"generateLogId,omitempty"`
+	Name                 string            `json:"name,omitempty"`
+	LogFormat            string            `json:"logFormat,omitempty"`
+	AcceptAny            bool              `json:"acceptAny,omitempty"`
+	SilentHeaders        bool              `json:"silentHeaders,omitempty"`
+	CaptureStreams       bool              `json:"captureStreams,omitempty"`
+	BodyContentTypes     []string          `json:"bodyContentTypes,omitempty"`
+	MaxRequestBodyBytes  int               `json:"maxRequestBodyBytes,omitempty"`
+	MaxResponseBodyBytes int               `json:"maxResponseBodyBytes,omitempty"`
+	BinaryBase64MaxBytes int               `json:"binaryBase64MaxBytes,omitempty"`
+	JWTHeaders           []string          `json:"jwtHeaders,omitempty"`
+	JWTClaims            []string          `json:"jwtClaims,omitempty"`
+	JWTClaimsMode        string            `json:"jwtClaimsMode,omitempty"`
+	JWTClaimsSalt        string            `json:"jwtClaimsSalt,omitempty"`
+	SessionIDFrom        []string          `json:"sessionIdFrom,omitempty"`
+	UserIDFrom           []string          `json:"userIdFrom,omitempty"`
+	HeaderRedacts        []string          `json:"headerRedacts,omitempty"`
+	QueryRedacts         []string          `json:"queryRedacts,omitempty"`
+	CookieAllow          []string          `json:"cookieAllow,omitempty"`
+	CookieDeny           []string          `json:"cookieDeny,omitempty"`
+	RequestBodyRedact    string            `json:"requestBodyRedact,omitempty"`
+	ResponseBodyRedact   string            `json:"responseBodyRedact,omitempty"`
+	BodyFieldRedacts     []string          `json:"bodyFieldRedacts,omitempty"`
+	PIIScrubbers         []PIIScrubber     `json:"piiScrubbers,omitempty"`
+	LangfuseHost         string            `json:"langfuseHost,omitempty"`
+	LangfusePublicKey    string            `json:"langfusePublicKey,omitempty"`
+	LangfuseSecretKey    string            `json:"langfuseSecretKey,omitempty"`
+	BatchMaxEvents       int               `json:"batchMaxEvents,omitempty"`
+	BatchMaxBytes        int               `json:"batchMaxBytes,omitempty"`
+	BatchFlushInterval   string            `json:"batchFlushInterval,omitempty"`
+	IngestionMaxBytes    int               `json:"ingestionMaxBytes,omitempty"`
+	OversizePolicy       string            `json:"oversizePolicy,omitempty"`
+	OffloadDir           string            `json:"offloadDir,omitempty"`
+	OffloadMaxBytes      int               `json:"offloadMaxBytes,omitempty"`
+	OffloadRetention     string            `json:"offloadRetention,omitempty"`
+	HealthProbeInterval  string            `json:"healthProbeInterval,omitempty"`
+	SpoolDir             string            `json:"spoolDir,omitempty"`
+	SpoolMaxBytes        int               `json:"spoolMaxBytes,omitempty"`
+	SpoolRetention       string            `json:"spoolRetention,omitempty"`
+	ShutdownTimeout      string            `json:"shutdownTimeout,omitempty"`
+	OTLPEndpoint         string            `json:"otlpEndpoint,omitempty"`
+	OTLPEncoding         string            `json:"otlpEncoding,omitempty"`
+	OTLPHeaders          map[string]string `json:"otlpHeaders,omitempty"`
 }
 
 func (c *Config) GetLangfuseFromEnv() {
@@ -66,58 +119,130 @@ type HTTPLogger interface {
 
 // LogRecord contains the loggable data.
 type LogRecord struct {
-	System                string
-	Proto                 string
-	Method                string
-	URL                   string
-	RemoteAddr            string
-	StatusCode            int
-	RequestHeaders        http.Header
-	RequestBody           *bytes.Buffer
-	ResponseHeaders       http.Header
-	ResponseBody          *bytes.Buffer
-	ResponseContentLength int
-	StartTime             time.Time
-	EndTime               time.Time
-	DurationMs            float64
-	RequestBodyDecoder    HTTPBodyDecoder
-	ResponseBodyDecoder   HTTPBodyDecoder
+	System                      string
+	Proto                       string
+	Method                      string
+	URL                         string
+	RemoteAddr                  string
+	StatusCode                  int
+	RequestHeaders              http.Header
+	TraceID                     string
+	SpanID                      string
+	ParentSpanID                string
+	LangfuseTraceID             string
+	LangfuseParentObservationID string
+	SessionID                   string
+	UserID                      string
+	JWTClaims                   map[string]interface{}
+	RequestContentType          string
+	RequestBody                 *bytes.Buffer
+	RequestContentLength        int
+	RequestBodyTruncated        bool
+	ResponseHeaders             http.Header
+	ResponseContentType         string
+	ResponseBody                *bytes.Buffer
+	ResponseContentLength       int
+	ResponseBodyTruncated       bool
+	StartTime                   time.Time
+	CompletionStartTime         time.Time
+	EndTime                     time.Time
+	DurationMs                  float64
+	RequestBodyDecoder          HTTPBodyDecoder
+	ResponseBodyDecoder         HTTPBodyDecoder
+}
+
+// decodeRequestBody decodes the request body, and tells whether it is truncated,
+// either by the capture limit or by the limit of its decompressed size.
+func (record *LogRecord) decodeRequestBody() (string, bool) {
+	text, err := record.RequestBodyDecoder.decode(record.RequestBody)
+	return text, record.RequestBodyTruncated || errors.Is(err, errBodyTruncated)
+}
+
+// decodeResponseBody decodes the response body, and tells whether it is truncated.
+func (record *LogRecord) decodeResponseBody() (string, bool) {
+	text, err := record.ResponseBodyDecoder.decode(record.ResponseBody)
+	return text, record.ResponseBodyTruncated || errors.Is(err, errBodyTruncated)
 }
 
 // LoggerMiddleware a Logger plugin.
 type LoggerMiddleware struct {
-	client              *langfuse.Client
-	name                string
-	clock               LoggerClock
-	logger              HTTPLogger
-	bodyDecoderFactory  *HTTPBodyDecoderFactory
-	acceptAny           bool
-	silentHeaders       bool
-	contentTypes        []string
-	jwtHeaders          []string
-	headerRedacts       []string
-	requestBodyRedacts  []string
-	responseBodyRedacts []string
-	next                http.Handler
+	client               *langfuse.Client
+	name                 string
+	clock                LoggerClock
+	logger               HTTPLogger
+	bodyDecoderFactory   *HTTPBodyDecoderFactory
+	acceptAny            bool
+	silentHeaders        bool
+	captureStreams       bool
+	contentTypes         []string
+	maxRequestBodyBytes  int
+	maxResponseBodyBytes int
+	binaryBase64MaxBytes int
+	jwtHeaders           []string
+	jwtClaims            []string
+	hashJWTClaims        bool
+	jwtClaimsSalt        []byte
+	sessionIDRules       []attributeRule
+	userIDRules          []attributeRule
+	attributeBody        bool
+	debugLogger          *log.Logger
+	headerRedacts        []string
+	queryRedacts         []string
+	cookieFilter         *cookieFilter
+	requestBodyRedacts   []string
+	responseBodyRedacts  []string
+	bodyFieldRedactions  []bodyFieldRedaction
+	piiScrubbers         []*piiScrubber
+	next                 http.Handler
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Enabled:            true,
-		Debug:              false,
-		GenerateLogID:      true,
-		Name:               "HTTP",
-		AcceptAny:          false,
-		SilentHeaders:      false,
-		BodyContentTypes:   []string{},
-		JWTHeaders:         []string{},
-		HeaderRedacts:      []string{},
-		RequestBodyRedact:  "",
-		ResponseBodyRedact: "",
-		LangfuseHost:       "",
-		LangfusePublicKey:  "",
-		LangfuseSecretKey:  "",
+		Enabled:              true,
+		Debug:                false,
+		GenerateLogID:        true,
+		Name:                 "HTTP",
+		LogFormat:            LogFormatLangfuse,
+		AcceptAny:            false,
+		SilentHeaders:        false,
+		CaptureStreams:       false,
+		BodyContentTypes:     []string{},
+		MaxRequestBodyBytes:  1024 * 1024,
+		MaxResponseBodyBytes: 1024 * 1024,
+		BinaryBase64MaxBytes: 0,
+		JWTHeaders:           []string{},
+		JWTClaims:            []string{},
+		JWTClaimsMode:        JWTClaimsModeDrop,
+		SessionIDFrom:        []string{},
+		UserIDFrom:           []string{},
+		HeaderRedacts:        []string{},
+		QueryRedacts:         []string{},
+		CookieAllow:          []string{},
+		CookieDeny:           []string{},
+		RequestBodyRedact:    "",
+		ResponseBodyRedact:   "",
+		BodyFieldRedacts:     []string{},
+		PIIScrubbers:         []PIIScrubber{},
+		LangfuseHost:         "",
+		LangfusePublicKey:    "",
+		LangfuseSecretKey:    "",
+		BatchMaxEvents:       100,
+		BatchMaxBytes:        3 * 1024 * 1024,
+		BatchFlushInterval:   "1s",
+		IngestionMaxBytes:    langfuse.DefaultMaxBatchBytes,
+		OversizePolicy:       string(langfuse.OversizePolicyTruncate),
+		OffloadDir:           "",
+		OffloadMaxBytes:      100 * 1024 * 1024,
+		OffloadRetention:     "168h",
+		HealthProbeInterval:  "10s",
+		SpoolDir:             "",
+		SpoolMaxBytes:        100 * 1024 * 1024,
+		SpoolRetention:       "24h",
+		ShutdownTimeout:      "5s",
+		OTLPEndpoint:         "",
+		OTLPEncoding:         OTLPEncodingProtobuf,
+		OTLPHeaders:          map[string]string{},
 	}
 }
 
@@ -134,39 +259,51 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		logger.Printf("log2fuse middleware config: %+v\n", config)
 	}
 
-	config.GetLangfuseFromEnv()
-	if len(config.LangfuseHost) == 0 || len(config.LangfusePublicKey) == 0 || len(config.LangfuseSecretKey) == 0 {
-		logger.Printf("langfuse host, public key, or secret key is not set, skipping langfuse logging")
+	httpLogger, client := createHTTPLogger(ctx, config, name, logger)
+	if httpLogger == nil {
+		logger.Printf("no logger is enabled for log format %q, skipping logging", config.LogFormat)
 
 		return &NoOpMiddleware{
 			next: next,
 		}, nil
 	}
 
-	client := langfuse.NewClient(config.LangfuseHost, config.LangfusePublicKey, config.LangfuseSecretKey)
-
-	health, err := client.Health(ctx)
-	if err != nil {
-		logger.Printf("langfuse health check failed, skipping langfuse logging: %v", err)
-		// 这里不返回，考虑到langfuse的启动后于插件启动
-	} else {
-		logger.Printf("langfuse health check: %+v", health)
+	sessionIDRules := parseAttributeRules(config.SessionIDFrom, logger)
+	userIDRules := parseAttributeRules(config.UserIDFrom, logger)
+	var debugLogger *log.Logger
+	if config.Debug {
+		debugLogger = logger
 	}
 
 	return &LoggerMiddleware{
-		client:              client,
-		name:                config.Name,
-		clock:               createClock(ctx),
-		logger:              createLangfuseLogger(ctx, config, logger, client),
-		bodyDecoderFactory:  createHTTPBodyDecoderFactory(logger),
-		acceptAny:           config.AcceptAny,
-		silentHeaders:       config.SilentHeaders,
-		contentTypes:        config.BodyContentTypes,
-		jwtHeaders:          config.JWTHeaders,
-		headerRedacts:       config.HeaderRedacts,
-		requestBodyRedacts:  strings.Split(config.RequestBodyRedact, ";"),
-		responseBodyRedacts: strings.Split(config.ResponseBodyRedact, ";"),
-		next:                next,
+		client:               client,
+		name:                 config.Name,
+		clock:                createClock(ctx),
+		logger:               httpLogger,
+		bodyDecoderFactory:   createHTTPBodyDecoderFactory(logger),
+		acceptAny:            config.AcceptAny,
+		silentHeaders:        config.SilentHeaders,
+		captureStreams:       config.CaptureStreams,
+		contentTypes:         config.BodyContentTypes,
+		maxRequestBodyBytes:  config.MaxRequestBodyBytes,
+		maxResponseBodyBytes: config.MaxResponseBodyBytes,
+		binaryBase64MaxBytes: config.BinaryBase64MaxBytes,
+		jwtHeaders:           config.JWTHeaders,
+		jwtClaims:            config.JWTClaims,
+		hashJWTClaims:        parseJWTClaimsMode(config.JWTClaimsMode, logger),
+		jwtClaimsSalt:        createJWTClaimsSalt(config, logger),
+		sessionIDRules:       sessionIDRules,
+		userIDRules:          userIDRules,
+		attributeBody:        hasAttributeSource(sessionIDRules, attributeSourceBody) || hasAttributeSource(userIDRules, attributeSourceBody),
+		debugLogger:          debugLogger,
+		headerRedacts:        config.HeaderRedacts,
+		queryRedacts:         config.QueryRedacts,
+		cookieFilter:         &cookieFilter{allow: config.CookieAllow, deny: config.CookieDeny},
+		requestBodyRedacts:   strings.Split(config.RequestBodyRedact, ";"),
+		responseBodyRedacts:  strings.Split(config.ResponseBodyRedact, ";"),
+		bodyFieldRedactions:  parseBodyFieldRedactions(config.BodyFieldRedacts, logger),
+		piiScrubbers:         createPIIScrubbers(config.PIIScrubbers, logger),
+		next:                 next,
 	}, nil
 }
 
@@ -177,27 +314,35 @@ func (m *LoggerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	accept := r.Header.Get("Accept")
-	if accept == "text/event-stream" || strings.HasPrefix(accept, "application/grpc-web") {
+	if strings.HasPrefix(accept, "application/grpc-web") || (isEventStream(accept) && !m.canCaptureStream(w)) {
 		// Disable plugin while https://github.com/traefik/yaegi/issues/1600 is not resolved.
 		m.next.ServeHTTP(w, r)
 		return
 	}
 
+	// 会话和用户 ID 的 body 规则不受日志过滤影响，需要时总是读取请求体
+	logRequestBody := !hasRedactedBody(r, m.requestBodyRedacts) && needToLogBody(m, r.Header.Get("Content-Type"), false)
 	mrc := &multiReadCloser{
 		rc:       r.Body,
 		buf:      &bytes.Buffer{},
-		withBody: !hasRedactedBody(r, m.requestBodyRedacts) && needToLogBody(m, r.Header.Get("Content-Type"), false),
+		withBody: logRequestBody || m.attributeBody,
+		limit:    m.maxRequestBodyBytes,
 	}
 	r.Body = mrc
 
 	mrw := &multiResponseWriter{
 		ResponseWriter: w,
+		clock:          m.clock,
 		status:         200, // Default is 200
 		body:           &bytes.Buffer{},
 		withBody:       !hasRedactedBody(r, m.responseBodyRedacts) && needToLogBody(m, r.Header.Get("Accept"), m.acceptAny),
+		limit:          m.maxResponseBodyBytes,
 	}
 
 	requestHeaders := m.copyHeaders(r.Header)
+	jwtClaims := m.extractJWTClaims(r.Header)
+	// 日志记录客户端发送的请求头，之后才注入 traceparent
+	span := startSpan(r.Header)
 
 	startTime := m.clock.Now()
 	m.next.ServeHTTP(mrw, r)
@@ -207,32 +352,84 @@ func (m *LoggerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	responseHeaders := m.copyHeaders(originalResponseHeaders)
 	durationMs := float64(endTime.UnixMicro()-startTime.UnixMicro()) / 1000.0
 
-	requestBodyDecoder := m.bodyDecoderFactory.create(requestHeaders.Get("Content-Encoding"))
-	responseBodyDecoder := m.bodyDecoderFactory.create(originalResponseHeaders.Get("Content-Encoding"))
+	requestBodyDecoder := m.bodyDecoderFactory.create(requestHeaders.Get("Content-Encoding"), m.maxRequestBodyBytes)
+	responseBodyDecoder := m.bodyDecoderFactory.create(originalResponseHeaders.Get("Content-Encoding"), m.maxResponseBodyBytes)
 	responseBuffer := m.selectResponseBodyBuffer(mrw, originalResponseHeaders.Get("Content-Type"))
 
+	// 会话和用户 ID 从未脱敏的请求体中读取
+	attributesBodyDecoder := requestBodyDecoder
+	attributes := &requestAttributes{
+		request:    r,
+		jwtHeaders: m.jwtHeaders,
+		logger:     m.debugLogger,
+		body: func() (string, bool) {
+			text, err := attributesBodyDecoder.decode(mrc.buf)
+			return text, mrc.truncated || errors.Is(err, errBodyTruncated)
+		},
+	}
+	requestBuffer := mrc.buf
+	if !logRequestBody {
+		requestBuffer = &bytes.Buffer{}
+	}
+
+	requestBodyDecoder = m.bodyDecoderFactory.createContent(requestBodyDecoder, r.Header.Get("Content-Type"), m.binaryBase64MaxBytes)
+	responseBodyDecoder = m.bodyDecoderFactory.createContent(responseBodyDecoder, originalResponseHeaders.Get("Content-Type"), m.binaryBase64MaxBytes)
+	if paths := matchBodyFieldRedactions(r, m.bodyFieldRedactions); len(paths) > 0 {
+		requestBodyDecoder = &RedactingHTTPDecoder{decoder: requestBodyDecoder, contentType: r.Header.Get("Content-Type"), paths: paths}
+		responseBodyDecoder = &RedactingHTTPDecoder{decoder: responseBodyDecoder, contentType: originalResponseHeaders.Get("Content-Type"), paths: paths}
+	}
+	if len(m.piiScrubbers) > 0 {
+		requestBodyDecoder = &ScrubbingHTTPDecoder{decoder: requestBodyDecoder, contentType: r.Header.Get("Content-Type"), scrubbers: m.piiScrubbers}
+		responseBodyDecoder = &ScrubbingHTTPDecoder{decoder: responseBodyDecoder, contentType: originalResponseHeaders.Get("Content-Type"), scrubbers: m.piiScrubbers}
+	}
+
 	logRecord := &LogRecord{
-		System:                m.name,
-		Proto:                 r.Proto,
-		Method:                r.Method,
-		URL:                   r.URL.String(),
-		RemoteAddr:            r.RemoteAddr,
-		StatusCode:            mrw.status,
-		RequestHeaders:        requestHeaders,
-		RequestBody:           mrc.buf,
-		ResponseHeaders:       responseHeaders,
-		ResponseBody:          responseBuffer,
-		ResponseContentLength: mrw.length,
-		StartTime:             startTime,
-		EndTime:               endTime,
-		DurationMs:            durationMs,
-		RequestBodyDecoder:    requestBodyDecoder,
-		ResponseBodyDecoder:   responseBodyDecoder,
+		System:                      m.name,
+		Proto:                       r.Proto,
+		Method:                      r.Method,
+		URL:                         redactQuery(r.URL.String(), m.queryRedacts),
+		RemoteAddr:                  r.RemoteAddr,
+		StatusCode:                  mrw.status,
+		RequestHeaders:              requestHeaders,
+		TraceID:                     span.TraceID,
+		SpanID:                      span.SpanID,
+		ParentSpanID:                span.ParentSpanID,
+		LangfuseTraceID:             r.Header.Get(langfuseTraceIDHeader),
+		LangfuseParentObservationID: r.Header.Get(langfuseParentObservationIDHeader),
+		SessionID:                   attributes.resolve("session id", m.sessionIDRules),
+		UserID:                      attributes.resolve("user id", m.userIDRules),
+		JWTClaims:                   jwtClaims,
+		RequestContentType:          r.Header.Get("Content-Type"),
+		RequestBody:                 requestBuffer,
+		RequestContentLength:        mrc.length,
+		RequestBodyTruncated:        mrc.truncated && logRequestBody,
+		ResponseHeaders:             responseHeaders,
+		ResponseContentType:         originalResponseHeaders.Get("Content-Type"),
+		ResponseBody:                responseBuffer,
+		ResponseContentLength:       mrw.length,
+		ResponseBodyTruncated:       mrw.truncated && responseBuffer == mrw.body,
+		StartTime:                   startTime,
+		CompletionStartTime:         mrw.completionStartTime(),
+		EndTime:                     endTime,
+		DurationMs:                  durationMs,
+		RequestBodyDecoder:          requestBodyDecoder,
+		ResponseBodyDecoder:         responseBodyDecoder,
 	}
 
 	m.logger.Print(logRecord)
 }
 
+// canCaptureStream tells whether an event stream can be logged: it must be
+// enabled and the writer must let every chunk be flushed to the client as
+// soon as it is written. Otherwise the stream is passed through untouched.
+func (m *LoggerMiddleware) canCaptureStream(w http.ResponseWriter) bool {
+	if !m.captureStreams {
+		return false
+	}
+	_, ok := w.(http.Flusher)
+	return ok
+}
+
 func needToLogBody(m *LoggerMiddleware, current string, acceptAny bool) bool {
 	for _, contentType := range m.contentTypes {
 		if acceptAny && (current == "" || current == "*/*") {
@@ -276,7 +473,24 @@ func (m *LoggerMiddleware) copyHeaders(original http.Header) http.Header {
 			continue
 		}
 		if containsIgnoreCase(m.jwtHeaders, key) {
-			newHeader[key] = decodeHeaders(value, decodeJWTHeader)
+			// 配置了 claim 白名单时 claim 单独记录，请求头只保留认证方式
+			if len(m.jwtClaims) > 0 {
+				newHeader[key] = decodeHeaders(value, redactJWTHeader)
+			} else {
+				newHeader[key] = decodeHeaders(value, decodeJWTHeader)
+			}
+			continue
+		}
+		if m.cookieFilter.enabled() && strings.EqualFold(key, "Cookie") {
+			newHeader[key] = decodeHeaders(value, m.cookieFilter.redactCookie)
+			continue
+		}
+		if m.cookieFilter.enabled() && strings.EqualFold(key, "Set-Cookie") {
+			newHeader[key] = decodeHeaders(value, m.cookieFilter.redactSetCookie)
+			continue
+		}
+		if len(m.queryRedacts) > 0 && containsFold(urlHeaders, key) {
+			newHeader[key] = decodeHeaders(value, func(v string) string { return redactQuery(v, m.queryRedacts) })
 			continue
 		}
 		newHeader[key] = value
@@ -284,30 +498,118 @@ func (m *LoggerMiddleware) copyHeaders(original http.Header) http.Header {
 	return newHeader
 }
 
+// extractJWTClaims returns the allowed claims of the JWT headers, by header name.
+// Returns nil when no claim allowlist is configured.
+func (m *LoggerMiddleware) extractJWTClaims(header http.Header) map[string]interface{} {
+	if len(m.jwtClaims) == 0 {
+		return nil
+	}
+
+	var result map[string]interface{}
+	for key, values := range header {
+		if len(values) == 0 || !containsIgnoreCase(m.jwtHeaders, key) {
+			continue
+		}
+		claims, ok := jwtClaims(values[0])
+		if !ok {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]interface{})
+		}
+		result[key] = filterJWTClaims(claims, m.jwtClaims, m.hashJWTClaims, m.jwtClaimsSalt)
+	}
+	return result
+}
+
 type multiResponseWriter struct {
 	http.ResponseWriter
-	status   int
-	length   int
-	body     *bytes.Buffer
-	withBody bool
+	clock          LoggerClock
+	status         int
+	length         int
+	body           *bytes.Buffer
+	withBody       bool
+	limit          int
+	truncated      bool
+	wroteHeader    bool
+	stream         bool
+	firstByteTime  time.Time
+	firstDeltaTime time.Time
+	pendingLine    []byte
 }
 
 var _ http.ResponseWriter = (*multiResponseWriter)(nil)
 
 func (w *multiResponseWriter) WriteHeader(status int) {
+	w.detectStream()
 	w.ResponseWriter.WriteHeader(status)
 	w.status = status
 }
 
 func (w *multiResponseWriter) Write(b []byte) (int, error) {
+	w.detectStream()
 	n, err := w.ResponseWriter.Write(b)
+	if n > 0 && w.firstByteTime.IsZero() {
+		w.firstByteTime = w.clock.Now()
+	}
+	if w.stream && w.firstDeltaTime.IsZero() {
+		w.scanFirstDelta(b[:n])
+	}
 	w.length += n
-	if w.withBody {
-		w.body.Write(b)
+	if w.withBody && !captureBody(w.body, b[:n], w.limit) {
+		w.truncated = true
+	}
+	if w.stream {
+		// Flush every chunk, the upstream flushes may not reach through the interpreter.
+		w.Flush()
 	}
 	return n, err
 }
 
+// detectStream checks once, when the headers are sent, whether the response is an event stream.
+func (w *multiResponseWriter) detectStream() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.stream = isEventStream(w.Header().Get("Content-Type"))
+}
+
+// maxPendingLineSize bounds the partial SSE line kept between two writes.
+const maxPendingLineSize = 64 * 1024
+
+// scanFirstDelta looks for the first SSE data line carrying generated output.
+// Lines may be split across writes, so the incomplete tail is kept for the next call.
+func (w *multiResponseWriter) scanFirstDelta(b []byte) {
+	data := append(w.pendingLine, b...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(data[:i], "\r")
+		data = data[i+1:]
+		if bytes.HasPrefix(line, []byte("data:")) && sseDataHasContent(string(bytes.TrimSpace(line[5:]))) {
+			w.firstDeltaTime = w.clock.Now()
+			w.pendingLine = nil
+			return
+		}
+	}
+	if len(data) > maxPendingLineSize {
+		data = nil
+	}
+	w.pendingLine = append([]byte(nil), data...)
+}
+
+// completionStartTime is the moment the first token reached the client:
+// the first non-empty delta of an event stream, the first body byte otherwise.
+func (w *multiResponseWriter) completionStartTime() time.Time {
+	if !w.firstDeltaTime.IsZero() {
+		return w.firstDeltaTime
+	}
+	return w.firstByteTime
+}
+
 var _ http.Flusher = (*multiResponseWriter)(nil)
 
 func (w *multiResponseWriter) Flush() {
@@ -336,19 +638,36 @@ func (w *multiResponseWriter) Push(target string, opts *http.PushOptions) error
 }
 
 type multiReadCloser struct {
-	rc       io.ReadCloser
-	buf      *bytes.Buffer
-	withBody bool
+	rc        io.ReadCloser
+	buf       *bytes.Buffer
+	withBody  bool
+	limit     int
+	length    int
+	truncated bool
 }
 
 func (mrc *multiReadCloser) Read(p []byte) (int, error) {
 	n, err := mrc.rc.Read(p)
-	if mrc.withBody && n > 0 {
-		mrc.buf.Write(p[:n])
+	mrc.length += n
+	if mrc.withBody && n > 0 && !captureBody(mrc.buf, p[:n], mrc.limit) {
+		mrc.truncated = true
 	}
 	return n, err
 }
 
+// captureBody buffers b until the buffer holds limit bytes, the rest is only streamed.
+// A limit of zero means no limit. Returns false when bytes were left out.
+func captureBody(buffer *bytes.Buffer, b []byte, limit int) bool {
+	if limit <= 0 || buffer.Len()+len(b) <= limit {
+		buffer.Write(b)
+		return true
+	}
+	if remaining := limit - buffer.Len(); remaining > 0 {
+		buffer.Write(b[:remaining])
+	}
+	return false
+}
+
 func (mrc *multiReadCloser) Close() error {
 	return mrc.rc.Close()
 }
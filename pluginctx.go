@@ -5,7 +5,9 @@ import (
 	"context"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/peace0phmind/log2fuse/langfuse"
@@ -85,10 +87,118 @@ func createJSONHTTPLogger(ctx context.Context, config *Config, logger *log.Logge
 	return &JSONHTTPLogger{clock: clock, uuidGenerator: uuidGenerator, logger: logger, writer: &FileLogWriter{file: os.Stdout}}
 }
 
-func createLangfuseLogger(ctx context.Context, config *Config, logger *log.Logger, client *langfuse.Client) *LangfuseLogger {
+func createTextHTTPLogger(ctx context.Context, logger *log.Logger) *TextHTTPLogger {
+	clock := createClock(ctx)
+	externalLogWriter, hasExternalLogWriter := ctx.Value(LogWriterContextKey).(LogWriter)
+	if hasExternalLogWriter {
+		return &TextHTTPLogger{clock: clock, logger: logger, writer: externalLogWriter}
+	}
+	return &TextHTTPLogger{clock: clock, logger: logger, writer: &FileLogWriter{file: os.Stdout}}
+}
+
+// createHTTPLogger creates a logger for every sink of the log format.
+// Returns nil when no sink could be created.
+func createHTTPLogger(ctx context.Context, config *Config, name string, logger *log.Logger) (HTTPLogger, *langfuse.Client) {
+	var loggers []HTTPLogger
+	var client *langfuse.Client
+
+	for _, format := range parseLogFormat(config.LogFormat) {
+		switch format {
+		case LogFormatJSON:
+			loggers = append(loggers, createJSONHTTPLogger(ctx, config, logger))
+		case LogFormatText:
+			loggers = append(loggers, createTextHTTPLogger(ctx, logger))
+		case LogFormatLangfuse:
+			client = createLangfuseClient(ctx, config, logger)
+			if client != nil {
+				loggers = append(loggers, createLangfuseLogger(ctx, config, name, logger, client))
+			}
+		case LogFormatOTLP:
+			if len(config.OTLPEndpoint) == 0 {
+				logger.Printf("otlp endpoint is not set, skipping otlp export")
+				continue
+			}
+			loggers = append(loggers, createOTLPHTTPLogger(ctx, config, logger))
+		default:
+			logger.Printf("unknown log format %q, ignoring it", format)
+		}
+	}
+
+	switch len(loggers) {
+	case 0:
+		return nil, client
+	case 1:
+		return loggers[0], client
+	default:
+		return &MultiHTTPLogger{loggers: loggers}, client
+	}
+}
+
+// parseLogFormat splits a log format like "json,langfuse" into its sinks
+func parseLogFormat(logFormat string) []string {
+	var formats []string
+	for _, format := range strings.FieldsFunc(logFormat, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	}) {
+		format = strings.ToLower(format)
+		if !containsString(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// createLangfuseClient creates the langfuse client, nil when it is not configured
+func createLangfuseClient(ctx context.Context, config *Config, logger *log.Logger) *langfuse.Client {
+	config.GetLangfuseFromEnv()
+	if len(config.LangfuseHost) == 0 || len(config.LangfusePublicKey) == 0 || len(config.LangfuseSecretKey) == 0 {
+		logger.Printf("langfuse host, public key, or secret key is not set, skipping langfuse logging")
+		return nil
+	}
+
+	client := langfuse.NewClient(config.LangfuseHost, config.LangfusePublicKey, config.LangfuseSecretKey, createLangfuseClientOptions(config, logger)...)
+
+	health, err := client.Health(ctx)
+	if err != nil {
+		logger.Printf("langfuse health check failed: %v", err)
+		// 这里不返回，考虑到langfuse的启动后于插件启动
+	} else {
+		logger.Printf("langfuse health check: %+v", health)
+	}
+
+	return client
+}
+
+func createLangfuseLogger(ctx context.Context, config *Config, name string, logger *log.Logger, client *langfuse.Client) *LangfuseLogger {
 	clock := createClock(ctx)
 	uuidGenerator := createUUIDGenerator(ctx, config)
-	langfuseLogger := NewLangfuseLogger(clock, uuidGenerator, logger, client)
+	options := LangfuseLoggerOptions{
+		BatchMaxEvents:      config.BatchMaxEvents,
+		BatchMaxBytes:       config.BatchMaxBytes,
+		BatchFlushInterval:  parseDuration(config.BatchFlushInterval, defaultBatchFlushInterval, logger),
+		HealthProbeInterval: parseDuration(config.HealthProbeInterval, defaultHealthProbeInterval, logger),
+		ShutdownTimeout:     parseDuration(config.ShutdownTimeout, defaultShutdownTimeout, logger),
+	}
+	if len(config.SpoolDir) > 0 {
+		retention := parseDuration(config.SpoolRetention, 0, logger)
+		// 每个中间件实例使用自己的子目录，避免多个实例重放同一个 spool
+		spoolDir := filepath.Join(config.SpoolDir, spoolDirName(name))
+		spool, err := NewSpool(spoolDir, int64(config.SpoolMaxBytes), retention, clock, logger)
+		if err != nil {
+			logger.Printf("spool disabled: %v", err)
+		} else {
+			options.Spool = spool
+		}
+	}
+	langfuseLogger := NewLangfuseLogger(clock, uuidGenerator, logger, client, options)
+
+	// Traefik 重新加载配置或退出时取消 ctx，此时发送剩余的记录
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			langfuseLogger.Close()
+		}()
+	}
 
 	// 设置 finalizer 来清理资源
 	runtime.SetFinalizer(langfuseLogger, func(l *LangfuseLogger) {
@@ -98,6 +208,96 @@ func createLangfuseLogger(ctx context.Context, config *Config, logger *log.Logge
 	return langfuseLogger
 }
 
+// spoolDirName turns a middleware name like "logger@file" into a directory name
+func spoolDirName(name string) string {
+	dirName := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(dirName, ".") == "" {
+		return "default"
+	}
+	return dirName
+}
+
+func createOTLPHTTPLogger(ctx context.Context, config *Config, logger *log.Logger) *OTLPHTTPLogger {
+	switch config.OTLPEncoding {
+	case OTLPEncodingProtobuf, OTLPEncodingJSON, "":
+	default:
+		logger.Printf("unknown otlp encoding %q, using %s", config.OTLPEncoding, OTLPEncodingProtobuf)
+	}
+
+	otlpLogger := NewOTLPHTTPLogger(logger, OTLPHTTPLoggerOptions{
+		Endpoint:           config.OTLPEndpoint,
+		Encoding:           config.OTLPEncoding,
+		Headers:            config.OTLPHeaders,
+		ServiceName:        config.Name,
+		BatchMaxSpans:      config.BatchMaxEvents,
+		BatchFlushInterval: parseDuration(config.BatchFlushInterval, defaultBatchFlushInterval, logger),
+		ShutdownTimeout:    parseDuration(config.ShutdownTimeout, defaultShutdownTimeout, logger),
+		Clock:              createClock(ctx),
+	})
+
+	// Traefik 重新加载配置或退出时取消 ctx，此时导出剩余的记录
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			otlpLogger.Close()
+		}()
+	}
+
+	return otlpLogger
+}
+
+func createLangfuseClientOptions(config *Config, logger *log.Logger) []langfuse.ClientOption {
+	options := []langfuse.ClientOption{langfuse.WithMaxBatchBytes(config.IngestionMaxBytes)}
+
+	switch langfuse.OversizePolicy(config.OversizePolicy) {
+	case langfuse.OversizePolicyOffload:
+		if len(config.OffloadDir) == 0 {
+			logger.Printf("oversize policy offload needs an offload directory, truncating oversized events instead")
+			break
+		}
+		options = append(options,
+			langfuse.WithOversizePolicy(langfuse.OversizePolicyOffload),
+			langfuse.WithOffloader(&langfuse.DirectoryOffloader{
+				Dir:       config.OffloadDir,
+				MaxBytes:  int64(config.OffloadMaxBytes),
+				Retention: parseDuration(config.OffloadRetention, 0, logger),
+			}))
+	case langfuse.OversizePolicyTruncate, "":
+		options = append(options, langfuse.WithOversizePolicy(langfuse.OversizePolicyTruncate))
+	default:
+		logger.Printf("unknown oversize policy %q, truncating oversized events instead", config.OversizePolicy)
+		options = append(options, langfuse.WithOversizePolicy(langfuse.OversizePolicyTruncate))
+	}
+
+	return options
+}
+
+// parseJWTClaimsMode tells whether the claims missing from the allowlist are hashed
+func parseJWTClaimsMode(mode string, logger *log.Logger) bool {
+	switch strings.ToLower(mode) {
+	case JWTClaimsModeHash:
+		return true
+	case JWTClaimsModeDrop, "":
+		return false
+	default:
+		logger.Printf("unknown jwt claims mode %q, dropping the claims that are not allowed", mode)
+		return false
+	}
+}
+
+// createJWTClaimsSalt returns the salt of the hashed JWT claims, nil when they are dropped
+func createJWTClaimsSalt(config *Config, logger *log.Logger) []byte {
+	if strings.ToLower(config.JWTClaimsMode) != JWTClaimsModeHash {
+		return nil
+	}
+	return hashSalt(config.JWTClaimsSalt, "the hashed jwt claims", logger)
+}
+
 func createUUIDGenerator(ctx context.Context, config *Config) UUIDGenerator {
 	if config.GenerateLogID {
 		externalUUIDGenerator, hasExternalUUIDGenerator := ctx.Value(UUIDGeneratorContextKey).(UUIDGenerator)
@@ -0,0 +1,369 @@
+package log2fuse
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Built-in PII scrubber presets, used as PIIScrubber.Name without a pattern.
+const (
+	PIIPresetEmail      = "email"
+	PIIPresetPhone      = "phone"
+	PIIPresetCreditCard = "creditCard"
+	PIIPresetIBAN       = "iban"
+	PIIPresetIPv4       = "ipv4"
+	PIIPresetIPv6       = "ipv6"
+	PIIPresetAPIKey     = "apiKey"
+)
+
+// How a PII scrubber replaces the values it finds.
+const (
+	// PIIModeRedact replaces the value with the redact marker.
+	PIIModeRedact = "redact"
+	// PIIModeHash replaces the value with its HMAC-SHA256 keyed with PIIScrubber.Salt, so equal
+	// values stay comparable. Without a salt a random salt of the process is used.
+	PIIModeHash = "hash"
+	// PIIModeLast keeps the last PIIScrubber.Keep characters of the value.
+	PIIModeLast = "last"
+)
+
+// PIIScrubber configures a named regex scrubber of the decoded bodies.
+// A scrubber without a pattern uses the preset of its name.
+type PIIScrubber struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Keep    int    `json:"keep,omitempty"`
+	Salt    string `json:"salt,omitempty"`
+}
+
+// piiPreset is a built-in pattern, with an optional check that filters out the false positives
+type piiPreset struct {
+	pattern string
+	valid   func(match string) bool
+}
+
+var piiPresets = map[string]piiPreset{
+	strings.ToLower(PIIPresetEmail): {
+		pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	},
+	strings.ToLower(PIIPresetPhone): {
+		// 末尾多匹配一段 .\d，以便识别并排除 IPv4 地址
+		pattern: `(?:\B\+\d{1,3}[ .-]?)?(?:\B\(\d{1,4}\)[ .-]?|\b\d{2,4}[ .-])\d{3,4}[ .-]?\d{3,4}(?:\.\d{1,3})?\b|\B\+\d{8,15}\b`,
+		valid:   phoneValid,
+	},
+	strings.ToLower(PIIPresetCreditCard): {
+		pattern: `\b(?:\d[ -]?){12,18}\d\b`,
+		valid:   luhnValid,
+	},
+	strings.ToLower(PIIPresetIBAN): {
+		pattern: `\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`,
+		valid:   ibanValid,
+	},
+	strings.ToLower(PIIPresetIPv4): {
+		pattern: `\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`,
+	},
+	strings.ToLower(PIIPresetIPv6): {
+		// 开头必须是单词或冒号边界，避免匹配 std::vector 之类的文本
+		pattern: `(?i)(?:\b[0-9a-f]{1,4}|\B:)(?::(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9a-f]{0,4})){2,7}`,
+		valid:   ipv6Valid,
+	},
+	strings.ToLower(PIIPresetAPIKey): {
+		pattern: `\bsk-[A-Za-z0-9_-]{20,}|\bAKIA[0-9A-Z]{16}\b|\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}\b|\bgithub_pat_[A-Za-z0-9_]{22,}`,
+	},
+}
+
+// hmacPrefix labels the hashed values
+const hmacPrefix = "hmac-sha256:"
+
+var (
+	processSaltOnce sync.Once
+	processSalt     []byte
+)
+
+// hashSalt returns the configured salt, or else a random salt of the process:
+// with an empty key the low entropy values, like emails, could be guessed back.
+func hashSalt(salt, owner string, logger *log.Logger) []byte {
+	if salt != "" {
+		return []byte(salt)
+	}
+	processSaltOnce.Do(func() {
+		processSalt = make([]byte, 32)
+		if _, err := rand.Read(processSalt); err != nil {
+			logger.Printf("Failed to generate a random salt: %v", err)
+		}
+	})
+	logger.Printf("no salt configured for %s, using a random salt: the hashes change on restart", owner)
+	return processSalt
+}
+
+// piiScrubber is a compiled PIIScrubber
+type piiScrubber struct {
+	pattern *regexp.Regexp
+	valid   func(match string) bool
+	mode    string
+	keep    int
+	salt    []byte
+}
+
+// createPIIScrubbers compiles the scrubbers, skipping the invalid ones
+func createPIIScrubbers(scrubbers []PIIScrubber, logger *log.Logger) []*piiScrubber {
+	var compiled []*piiScrubber
+	for _, scrubber := range scrubbers {
+		pattern := scrubber.Pattern
+		var valid func(string) bool
+		if pattern == "" {
+			preset, ok := piiPresets[strings.ToLower(scrubber.Name)]
+			if !ok {
+				logger.Printf("unknown PII scrubber preset %q and no pattern", scrubber.Name)
+				continue
+			}
+			pattern, valid = preset.pattern, preset.valid
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Printf("invalid pattern of PII scrubber %q: %s", scrubber.Name, err)
+			continue
+		}
+
+		mode := strings.ToLower(scrubber.Mode)
+		switch mode {
+		case "":
+			mode = PIIModeRedact
+		case PIIModeRedact, PIIModeHash, PIIModeLast:
+		default:
+			logger.Printf("unknown mode %q of PII scrubber %q, redacting", scrubber.Mode, scrubber.Name)
+			mode = PIIModeRedact
+		}
+
+		var salt []byte
+		if mode == PIIModeHash {
+			salt = hashSalt(scrubber.Salt, fmt.Sprintf("PII scrubber %q", scrubber.Name), logger)
+		}
+
+		compiled = append(compiled, &piiScrubber{
+			pattern: re,
+			valid:   valid,
+			mode:    mode,
+			keep:    scrubber.Keep,
+			salt:    salt,
+		})
+	}
+	return compiled
+}
+
+func (s *piiScrubber) scrub(text string) string {
+	return s.pattern.ReplaceAllStringFunc(text, func(match string) string {
+		if s.valid != nil && !s.valid(match) {
+			return match
+		}
+		return s.replace(match)
+	})
+}
+
+func (s *piiScrubber) replace(value string) string {
+	switch s.mode {
+	case PIIModeHash:
+		mac := hmac.New(sha256.New, s.salt)
+		mac.Write([]byte(value))
+		return hmacPrefix + hex.EncodeToString(mac.Sum(nil))
+	case PIIModeLast:
+		if s.keep <= 0 || utf8.RuneCountInString(value) <= s.keep {
+			return redactedValue
+		}
+		runes := []rune(value)
+		return redactedValue + string(runes[len(runes)-s.keep:])
+	default:
+		return redactedValue
+	}
+}
+
+// scrubPII runs every scrubber over the text, in order
+func scrubPII(text string, scrubbers []*piiScrubber) string {
+	for _, scrubber := range scrubbers {
+		text = scrubber.scrub(text)
+	}
+	return text
+}
+
+// luhnValid checks the Luhn checksum of the digits of a card number
+func luhnValid(number string) bool {
+	sum := 0
+	digits := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// ibanValid checks the ISO 7064 mod 97 checksum of an IBAN
+func ibanValid(iban string) bool {
+	iban = strings.ReplaceAll(iban, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	// 把前四位移到末尾，字母换成 10 到 35 的数字，逐位取模
+	remainder := 0
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			remainder = (remainder*100 + int(c-'A'+10)) % 97
+		default:
+			return false
+		}
+	}
+	return remainder == 1
+}
+
+// phoneValid filters out the IPv4 addresses, whose dotted groups look like a phone number
+func phoneValid(number string) bool {
+	return net.ParseIP(number) == nil
+}
+
+// ipv6Valid filters out the matches that only look like an IPv6 address, like times,
+// and the short ones like fe::de that are more likely text than an address
+func ipv6Valid(address string) bool {
+	if ip := net.ParseIP(address); ip == nil || !strings.Contains(address, ":") {
+		return false
+	}
+	groups := 0
+	for _, group := range strings.Split(address, ":") {
+		switch {
+		case strings.Contains(group, "."):
+			groups += 2 // 内嵌的 IPv4 地址占两组
+		case group != "":
+			groups++
+		}
+	}
+	return groups >= 3
+}
+
+// scrubBodyPII scrubs the string values of a JSON body, of each line of an NDJSON
+// body or of each data line of an event stream, so that a number looking like a
+// card number does not turn the JSON invalid. The other bodies are scrubbed as text.
+func scrubBodyPII(text, contentType string, scrubbers []*piiScrubber) string {
+	if len(scrubbers) == 0 {
+		return text
+	}
+	if scrubbed, ok := scrubJSONText(text, scrubbers); ok {
+		return scrubbed
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case isNDJSONContentType(mediaType):
+		return scrubLines(text, "", scrubbers)
+	case isEventStream(contentType) || looksLikeEventStream(text):
+		return scrubLines(text, "data:", scrubbers)
+	default:
+		return scrubPII(text, scrubbers)
+	}
+}
+
+// scrubJSONText scrubs the string values of a JSON text.
+// Returns false when the text is not JSON.
+func scrubJSONText(text string, scrubbers []*piiScrubber) (string, bool) {
+	value, ok := parseJSONValue(text)
+	if !ok {
+		return text, false
+	}
+	value, scrubbed := scrubJSONValue(value, scrubbers)
+	if !scrubbed {
+		return text, true
+	}
+	scrubbedText, err := encodeJSON(value)
+	if err != nil {
+		return redactedValue, true
+	}
+	return scrubbedText, true
+}
+
+// scrubJSONValue scrubs the strings of a parsed JSON value, in place for the
+// objects and arrays. Returns whether something was replaced.
+func scrubJSONValue(value interface{}, scrubbers []*piiScrubber) (interface{}, bool) {
+	scrubbed := false
+	switch v := value.(type) {
+	case string:
+		text := scrubPII(v, scrubbers)
+		return text, text != v
+	case map[string]interface{}:
+		for key, child := range v {
+			if replaced, ok := scrubJSONValue(child, scrubbers); ok {
+				v[key] = replaced
+				scrubbed = true
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if replaced, ok := scrubJSONValue(child, scrubbers); ok {
+				v[i] = replaced
+				scrubbed = true
+			}
+		}
+	}
+	return value, scrubbed
+}
+
+// scrubLines scrubs the JSON of each line starting with the prefix, the other lines as text
+func scrubLines(text, prefix string, scrubbers []*piiScrubber) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		data, found := strings.CutPrefix(line, prefix)
+		data = strings.TrimSpace(data)
+		scrubbed, ok := "", false
+		if found && data != "" {
+			scrubbed, ok = scrubJSONText(data, scrubbers)
+		}
+		if !ok {
+			lines[i] = scrubPII(line, scrubbers)
+			continue
+		}
+		if scrubbed == data {
+			continue
+		}
+		if prefix != "" {
+			scrubbed = prefix + " " + scrubbed
+		}
+		lines[i] = scrubbed
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ScrubbingHTTPDecoder scrubs the PII of the body decoded by another decoder.
+type ScrubbingHTTPDecoder struct {
+	decoder     HTTPBodyDecoder
+	contentType string
+	scrubbers   []*piiScrubber
+}
+
+func (d *ScrubbingHTTPDecoder) decode(content *bytes.Buffer) (string, error) {
+	// 截断的 body 解码出错时仍会返回部分内容，同样需要清理
+	text, err := d.decoder.decode(content)
+	return scrubBodyPII(text, d.contentType, d.scrubbers), err
+}
@@ -0,0 +1,269 @@
+package log2fuse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peace0phmind/log2fuse/langfuse"
+)
+
+const (
+	spoolSegmentSuffix = ".json"
+	// spoolLockFile marks the spool being replayed, so that two instances
+	// sharing the directory do not send the same segments
+	spoolLockFile = "replay.lock"
+	// spoolLockStale is the age after which the lock of a crashed instance is taken over
+	spoolLockStale = 5 * time.Minute
+)
+
+// errSpoolLocked is returned by Replay while another instance replays the spool
+var errSpoolLocked = errors.New("spool is being replayed by another instance")
+
+// Spool is an on-disk write-ahead queue of ingestion events. It keeps the
+// events that cannot be sent while langfuse is unreachable, so that they
+// are replayed in order once it recovers.
+//
+// Every write creates a segment file named after its write time, so the
+// lexical order of the segments is the order of the writes.
+type Spool struct {
+	dir       string
+	maxBytes  int64
+	retention time.Duration
+	clock     LoggerClock
+	logger    *log.Logger
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewSpool creates the spool directory if needed.
+// A zero maxBytes or retention means no limit.
+func NewSpool(dir string, maxBytes int64, retention time.Duration, clock LoggerClock, logger *log.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return &Spool{
+		dir:       dir,
+		maxBytes:  maxBytes,
+		retention: retention,
+		clock:     clock,
+		logger:    logger,
+	}, nil
+}
+
+// Write appends the events to the spool as a new segment.
+func (s *Spool) Write(events []langfuse.IngestionEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spooled events: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%09d%s", s.clock.Now().UnixNano(), s.seq, spoolSegmentSuffix)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("failed to write spool segment: %w", err)
+	}
+	// 先写临时文件再重命名，避免回放读到写了一半的段
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("failed to commit spool segment: %w", err)
+	}
+
+	s.enforceLimits()
+	return nil
+}
+
+// Pending tells whether the spool holds segments to replay.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.segments()
+	return err == nil && len(segments) > 0
+}
+
+// Replay sends the segments in order and removes each one once sent.
+// It stops at the first failure, keeping the failed segment for later.
+// The spool is only locked while a segment is read or removed, so that
+// writes are not blocked by the sends. Returns errSpoolLocked while another
+// instance replays the same directory.
+// Returns the number of replayed events.
+func (s *Spool) Replay(send func(events []langfuse.IngestionEvent) error) (int, error) {
+	if !s.lockReplay() {
+		return 0, errSpoolLocked
+	}
+	defer s.unlockReplay()
+
+	s.mu.Lock()
+	s.enforceLimits()
+	segments, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, segment := range segments {
+		path := filepath.Join(s.dir, segment)
+		events, err := s.readSegment(path)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read spool segment %s: %w", segment, err)
+		}
+		if events == nil {
+			continue
+		}
+
+		s.refreshReplayLock()
+		if err := send(events); err != nil {
+			return replayed, err
+		}
+		replayed += len(events)
+
+		s.mu.Lock()
+		s.remove(path)
+		s.mu.Unlock()
+	}
+
+	return replayed, nil
+}
+
+// readSegment reads the events of a segment. Returns no events for a
+// segment removed by the limits or corrupted, which is dropped.
+func (s *Spool) readSegment(path string) ([]langfuse.IngestionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var events []langfuse.IngestionEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		s.logger.Printf("Dropping corrupted spool segment %s: %v", filepath.Base(path), err)
+		s.remove(path)
+		return nil, nil
+	}
+	return events, nil
+}
+
+// lockReplay creates the replay lock file. A lock older than spoolLockStale
+// was left by a stopped instance and is taken over.
+func (s *Spool) lockReplay() bool {
+	path := filepath.Join(s.dir, spoolLockFile)
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+		if err == nil {
+			tryClose(file, s.logger)
+			s.refreshReplayLock()
+			return true
+		}
+		if !os.IsExist(err) {
+			s.logger.Printf("Failed to lock the spool for replay: %v", err)
+			return false
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || s.clock.Now().Sub(info.ModTime()) <= spoolLockStale {
+			return false
+		}
+		s.logger.Printf("Taking over the stale spool replay lock %s", path)
+		s.remove(path)
+	}
+	return false
+}
+
+// refreshReplayLock keeps the replay lock from becoming stale during a long replay
+func (s *Spool) refreshReplayLock() {
+	now := s.clock.Now()
+	if err := os.Chtimes(filepath.Join(s.dir, spoolLockFile), now, now); err != nil {
+		s.logger.Printf("Failed to refresh the spool replay lock: %v", err)
+	}
+}
+
+func (s *Spool) unlockReplay() {
+	s.remove(filepath.Join(s.dir, spoolLockFile))
+}
+
+// segments lists the segment files, oldest first.
+func (s *Spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %w", err)
+	}
+
+	var segments []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolSegmentSuffix) {
+			segments = append(segments, entry.Name())
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// enforceLimits removes the segments older than the retention, then the
+// oldest segments until the spool fits in maxBytes.
+func (s *Spool) enforceLimits() {
+	segments, err := s.segments()
+	if err != nil {
+		s.logger.Printf("Failed to enforce spool limits: %v", err)
+		return
+	}
+
+	var total int64
+	sizes := make([]int64, len(segments))
+	for i, segment := range segments {
+		if info, err := os.Stat(filepath.Join(s.dir, segment)); err == nil {
+			sizes[i] = info.Size()
+			total += info.Size()
+		}
+	}
+
+	now := s.clock.Now()
+	for i, segment := range segments {
+		expired := s.retention > 0 && now.Sub(segmentTime(segment)) > s.retention
+		oversized := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !oversized {
+			break
+		}
+		s.logger.Printf("Dropping spool segment %s (expired: %t, spool size: %d bytes), its events are lost", segment, expired, total)
+		s.remove(filepath.Join(s.dir, segment))
+		total -= sizes[i]
+	}
+}
+
+func (s *Spool) remove(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		s.logger.Printf("Failed to remove spool segment: %v", err)
+	}
+}
+
+// segmentTime parses the write time from a segment name.
+func segmentTime(segment string) time.Time {
+	prefix, _, _ := strings.Cut(segment, "-")
+	nanos, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
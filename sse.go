@@ -0,0 +1,350 @@
+package log2fuse
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// sseEvent is a single dispatched Server-Sent Events frame.
+type sseEvent struct {
+	event string
+	data  string
+}
+
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "text/event-stream")
+}
+
+// looksLikeEventStream sniffs the body when the content type was not captured.
+func looksLikeEventStream(body string) bool {
+	trimmed := strings.TrimLeft(body, " \r\n")
+	return strings.HasPrefix(trimmed, "data:") || strings.HasPrefix(trimmed, "event:")
+}
+
+// parseSSE splits an event stream into its frames as described by the
+// WHATWG Server-Sent Events specification. Comments, id and retry fields are ignored.
+func parseSSE(body string) []sseEvent {
+	var events []sseEvent
+	var event string
+	var data []string
+	hasData := false
+
+	dispatch := func() {
+		if hasData {
+			events = append(events, sseEvent{event: event, data: strings.Join(data, "\n")})
+		}
+		event = ""
+		data = nil
+		hasData = false
+	}
+
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\r", "\n")
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" {
+			dispatch()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+			hasData = true
+		}
+	}
+	// a stream cut before the final blank line still carries its last frame
+	dispatch()
+
+	return events
+}
+
+// sseDataHasContent tells whether a data frame carries generated output,
+// as opposed to role announcements, pings or usage-only chunks.
+func sseDataHasContent(data string) bool {
+	var frame map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &frame); err != nil {
+		return false
+	}
+
+	// OpenAI chat completion chunk
+	for _, item := range jsonArray(frame["choices"]) {
+		delta := jsonObject(jsonObject(item)["delta"])
+		if jsonString(delta["content"]) != "" || jsonString(delta["reasoning_content"]) != "" || len(jsonArray(delta["tool_calls"])) > 0 {
+			return true
+		}
+	}
+
+	// Anthropic message frames
+	switch jsonString(frame["type"]) {
+	case "content_block_start":
+		return jsonString(jsonObject(frame["content_block"])["type"]) == "tool_use"
+	case "content_block_delta":
+		delta := jsonObject(frame["delta"])
+		return jsonString(delta["text"]) != "" || jsonString(delta["thinking"]) != "" || jsonString(delta["partial_json"]) != ""
+	}
+
+	return false
+}
+
+// llmResponse decodes a JSON response body, or rebuilds it from an event stream.
+func llmResponse(record *LogRecord, responseBody string, reassemble func([]sseEvent) map[string]interface{}) map[string]interface{} {
+	if isEventStream(record.ResponseContentType) || looksLikeEventStream(responseBody) {
+		return reassemble(parseSSE(responseBody))
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil
+	}
+	return response
+}
+
+type openAIStreamToolCall struct {
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+type openAIStreamChoice struct {
+	role         string
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolCalls    map[int]*openAIStreamToolCall
+	finishReason interface{}
+}
+
+// reassembleOpenAIStream rebuilds a chat completion from its `data: {...}` chunks.
+func reassembleOpenAIStream(events []sseEvent) map[string]interface{} {
+	response := map[string]interface{}{"object": "chat.completion"}
+	choices := make(map[int]*openAIStreamChoice)
+	hasChunk := false
+
+	for _, event := range events {
+		if event.data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(event.data), &chunk); err != nil {
+			continue
+		}
+		if apiError, ok := chunk["error"]; ok {
+			return map[string]interface{}{"error": apiError}
+		}
+		hasChunk = true
+
+		for _, key := range []string{"id", "model", "created", "system_fingerprint"} {
+			if value, ok := chunk[key]; ok && value != nil {
+				response[key] = value
+			}
+		}
+		if usage := jsonObject(chunk["usage"]); usage != nil {
+			response["usage"] = usage
+		}
+
+		for _, item := range jsonArray(chunk["choices"]) {
+			choiceChunk := jsonObject(item)
+			index := jsonInt(choiceChunk["index"])
+			choice, ok := choices[index]
+			if !ok {
+				choice = &openAIStreamChoice{toolCalls: make(map[int]*openAIStreamToolCall)}
+				choices[index] = choice
+			}
+			if reason, ok := choiceChunk["finish_reason"]; ok && reason != nil {
+				choice.finishReason = reason
+			}
+
+			delta := jsonObject(choiceChunk["delta"])
+			if role := jsonString(delta["role"]); role != "" {
+				choice.role = role
+			}
+			choice.content.WriteString(jsonString(delta["content"]))
+			choice.reasoning.WriteString(jsonString(delta["reasoning_content"]))
+			for _, toolItem := range jsonArray(delta["tool_calls"]) {
+				toolChunk := jsonObject(toolItem)
+				toolIndex := jsonInt(toolChunk["index"])
+				toolCall, ok := choice.toolCalls[toolIndex]
+				if !ok {
+					toolCall = &openAIStreamToolCall{}
+					choice.toolCalls[toolIndex] = toolCall
+				}
+				if id := jsonString(toolChunk["id"]); id != "" {
+					toolCall.id = id
+				}
+				function := jsonObject(toolChunk["function"])
+				if name := jsonString(function["name"]); name != "" {
+					toolCall.name = name
+				}
+				toolCall.arguments.WriteString(jsonString(function["arguments"]))
+			}
+		}
+	}
+
+	if !hasChunk {
+		return nil
+	}
+
+	indexes := make([]int, 0, len(choices))
+	for index := range choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	assembled := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		choice := choices[index]
+		role := choice.role
+		if role == "" {
+			role = "assistant"
+		}
+		message := map[string]interface{}{
+			"role":    role,
+			"content": choice.content.String(),
+		}
+		if choice.reasoning.Len() > 0 {
+			message["reasoning_content"] = choice.reasoning.String()
+		}
+		if len(choice.toolCalls) > 0 {
+			message["tool_calls"] = openAIStreamToolCalls(choice.toolCalls)
+		}
+		assembled = append(assembled, map[string]interface{}{
+			"index":         index,
+			"message":       message,
+			"finish_reason": choice.finishReason,
+		})
+	}
+	response["choices"] = assembled
+
+	return response
+}
+
+func openAIStreamToolCalls(toolCalls map[int]*openAIStreamToolCall) []interface{} {
+	indexes := make([]int, 0, len(toolCalls))
+	for index := range toolCalls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	assembled := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		toolCall := toolCalls[index]
+		assembled = append(assembled, map[string]interface{}{
+			"id":   toolCall.id,
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":      toolCall.name,
+				"arguments": toolCall.arguments.String(),
+			},
+		})
+	}
+	return assembled
+}
+
+type anthropicStreamBlock struct {
+	block   map[string]interface{}
+	text    strings.Builder
+	partial strings.Builder
+}
+
+// reassembleAnthropicStream rebuilds a message from its `event:` typed frames.
+func reassembleAnthropicStream(events []sseEvent) map[string]interface{} {
+	var message map[string]interface{}
+	blocks := make(map[int]*anthropicStreamBlock)
+	usage := make(map[string]interface{})
+
+	for _, event := range events {
+		var frame map[string]interface{}
+		if err := json.Unmarshal([]byte(event.data), &frame); err != nil {
+			continue
+		}
+		frameType := event.event
+		if frameType == "" {
+			frameType = jsonString(frame["type"])
+		}
+
+		switch frameType {
+		case "error":
+			return map[string]interface{}{"type": "error", "error": frame["error"]}
+		case "message_start":
+			message = jsonObject(frame["message"])
+			for key, value := range jsonObject(message["usage"]) {
+				usage[key] = value
+			}
+		case "content_block_start":
+			blocks[jsonInt(frame["index"])] = &anthropicStreamBlock{block: jsonObject(frame["content_block"])}
+		case "content_block_delta":
+			block, ok := blocks[jsonInt(frame["index"])]
+			if !ok {
+				continue
+			}
+			delta := jsonObject(frame["delta"])
+			switch jsonString(delta["type"]) {
+			case "text_delta":
+				block.text.WriteString(jsonString(delta["text"]))
+			case "thinking_delta":
+				block.text.WriteString(jsonString(delta["thinking"]))
+			case "input_json_delta":
+				block.partial.WriteString(jsonString(delta["partial_json"]))
+			}
+		case "message_delta":
+			if message == nil {
+				continue
+			}
+			for key, value := range jsonObject(frame["delta"]) {
+				message[key] = value
+			}
+			for key, value := range jsonObject(frame["usage"]) {
+				usage[key] = value
+			}
+		}
+	}
+
+	if message == nil {
+		return nil
+	}
+
+	indexes := make([]int, 0, len(blocks))
+	for index := range blocks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	content := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		content = append(content, blocks[index].assemble())
+	}
+	message["content"] = content
+	message["usage"] = usage
+
+	return message
+}
+
+func (b *anthropicStreamBlock) assemble() map[string]interface{} {
+	block := make(map[string]interface{}, len(b.block))
+	for key, value := range b.block {
+		block[key] = value
+	}
+
+	switch jsonString(block["type"]) {
+	case "text":
+		block["text"] = jsonString(block["text"]) + b.text.String()
+	case "thinking":
+		block["thinking"] = jsonString(block["thinking"]) + b.text.String()
+	case "tool_use":
+		if b.partial.Len() > 0 {
+			var input interface{}
+			if err := json.Unmarshal([]byte(b.partial.String()), &input); err == nil {
+				block["input"] = input
+			} else {
+				block["input"] = b.partial.String()
+			}
+		}
+	}
+	return block
+}
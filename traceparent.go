@@ -0,0 +1,94 @@
+package log2fuse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers of the Langfuse SDKs to nest a request under an existing Langfuse trace.
+const (
+	langfuseTraceIDHeader             = "X-Langfuse-Trace-Id"
+	langfuseParentObservationIDHeader = "X-Langfuse-Parent-Observation-Id"
+)
+
+// spanContext places the span of a request in its trace.
+type spanContext struct {
+	TraceID      string // 32 lowercase hex characters
+	SpanID       string // 16 lowercase hex characters
+	ParentSpanID string // empty when the request started the trace
+}
+
+// startSpan continues the incoming traceparent. Without a valid one it
+// starts a new trace and injects its traceparent into the header, so that
+// the upstream spans become children of the request span.
+func startSpan(header http.Header) spanContext {
+	span := spanContext{SpanID: randomHex(8)}
+	if parent, ok := parseTraceParent(header.Get("Traceparent")); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.ParentID
+		return span
+	}
+
+	span.TraceID = randomHex(16)
+	header.Set("Traceparent", fmt.Sprintf("00-%s-%s-01", span.TraceID, span.SpanID))
+	return span
+}
+
+// TraceParent is a parsed W3C Trace Context traceparent header.
+type TraceParent struct {
+	TraceID  string // 32 lowercase hex characters
+	ParentID string // 16 lowercase hex characters
+	Flags    byte
+}
+
+// parseTraceParent parses a traceparent header as described by
+// https://www.w3.org/TR/trace-context/#traceparent-header.
+// Returns false when the header is missing or invalid.
+func parseTraceParent(value string) (TraceParent, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return TraceParent{}, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// future versions may append fields, version 00 must have exactly four
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return TraceParent{}, false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return TraceParent{}, false
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return TraceParent{}, false
+	}
+	if !isLowerHex(flags, 2) {
+		return TraceParent{}, false
+	}
+
+	decoded, _ := hex.DecodeString(flags)
+	return TraceParent{TraceID: traceID, ParentID: parentID, Flags: decoded[0]}, true
+}
+
+func isLowerHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes as lowercase hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,40 @@
+package log2fuse
+
+import (
+	"net/url"
+	"strings"
+)
+
+// urlHeaders are the headers whose values are URLs, their query is redacted like the request URL
+var urlHeaders = []string{"Referer", "Location", "Content-Location"}
+
+// redactQuery redacts the values of the query parameters named in names,
+// keeping the order and the encoding of the other parameters.
+func redactQuery(rawURL string, names []string) string {
+	if len(names) == 0 {
+		return rawURL
+	}
+	base, query, found := strings.Cut(rawURL, "?")
+	if !found {
+		return rawURL
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+
+	parameters := strings.Split(query, "&")
+	for i, parameter := range parameters {
+		key, value, _ := strings.Cut(parameter, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if value != "" && containsFold(names, name) {
+			parameters[i] = key + "=" + redactedValue
+		}
+	}
+
+	redacted := base + "?" + strings.Join(parameters, "&")
+	if hasFragment {
+		redacted += "#" + fragment
+	}
+	return redacted
+}
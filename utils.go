@@ -1,9 +1,12 @@
 package log2fuse
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
 	"log"
 	"strings"
+	"time"
 )
 
 func containsIgnoreCase(values []string, value string) bool {
@@ -15,11 +18,33 @@ func containsIgnoreCase(values []string, value string) bool {
 	return false
 }
 
+func containsString(values []string, value string) bool {
+	for _, str := range values {
+		if str == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedValue replaces the redacted values in the logs
+const redactedValue = "██"
+
+// containsFold tells whether values holds value, ignoring the case
+func containsFold(values []string, value string) bool {
+	for _, str := range values {
+		if strings.EqualFold(str, value) {
+			return true
+		}
+	}
+	return false
+}
+
 func redact(text string) string {
 	if len(text) == 0 {
 		return ""
 	}
-	return "██"
+	return redactedValue
 }
 
 func decodeEach(value []string, decoder func(string) (string, error)) ([]string, error) {
@@ -43,9 +68,32 @@ func decodeHeaders(value []string, decoder func(string) string) []string {
 	return decodedValues
 }
 
+// encodeJSON encodes a value without escaping the HTML characters, as logs are not HTML
+func encodeJSON(value interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
 func tryClose(closer io.Closer, logger *log.Logger) {
 	err := closer.Close()
 	if err != nil {
 		logger.Printf("Failed to close: %s", err)
 	}
 }
+
+func parseDuration(value string, fallback time.Duration, logger *log.Logger) time.Duration {
+	if len(value) == 0 {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		logger.Printf("Invalid duration %q, using %s", value, fallback)
+		return fallback
+	}
+	return duration
+}